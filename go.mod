@@ -2,6 +2,9 @@ module github.com/catatsuy/purl
 
 go 1.25.0
 
-require golang.org/x/term v0.45.0
+require (
+	golang.org/x/term v0.45.0
+	golang.org/x/text v0.41.0
+)
 
 require golang.org/x/sys v0.47.0 // indirect
@@ -2,16 +2,20 @@ package cli
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"regexp"
 	"runtime"
 	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
+
+	"github.com/catatsuy/purl/purl"
 )
 
 const (
@@ -19,12 +23,42 @@ const (
 	ExitCodeParseFlagError = 2
 	ExitCodeFail           = 2
 	ExitCodeNoMatch        = 1
+	// ExitCodeChanged is returned by -diff when an input would change, like
+	// diff(1)
+	ExitCodeChanged = 1
 )
 
 var (
 	Version string
 )
 
+const (
+	binarySkip  = "skip"
+	binaryText  = "text"
+	binaryError = "error"
+)
+
+const (
+	invalidJSONPass   = "pass"
+	invalidJSONReport = "report"
+)
+
+// stdinName is the file name printed by -H for standard input
+const stdinName = "(standard input)"
+
+var errBinaryFile = errors.New("binary file (use -encoding if it is text in another encoding, or -binary=text to process it as text)")
+
+// compressedFileError is returned for a compressed file that -overwrite or
+// -patch cannot handle. Such files are skipped so that the other files are
+// still written.
+type compressedFileError struct {
+	format purl.CompressionFormat
+}
+
+func (e *compressedFileError) Error() string {
+	return fmt.Sprintf("%s compressed file", e.format)
+}
+
 func version() string {
 	if Version != "" {
 		return Version
@@ -56,18 +90,96 @@ type CLI struct {
 	isStdoutTerminal bool
 
 	filePaths   []string
-	replaceExpr string
+	fromStdin   bool
+	operations  []operation
 	isOverwrite bool
-	filters     rawStrings
-	excludes    rawStrings
-	extractExpr string
 	help        bool
 	isColor     bool
 	ignoreCase  bool
 	lineMode    bool
+	chomp       bool
 	failMode    bool
 	version     bool
 
+	countMode      bool
+	listMatches    bool
+	listNonMatches bool
+	nullSeparated  bool
+	// countStage is the stage whose matches are counted by -count
+	countStage int
+
+	lineNumber   bool
+	byteOffset   bool
+	withFilename bool
+	noFilename   bool
+
+	rangeFrom   string
+	rangeAfter  string
+	rangeTo     string
+	rangeBefore string
+	lineSpecs   rawStrings
+	guardOn     rawStrings
+	guardNotOn  rawStrings
+	scope       purl.Scope
+	passThrough bool
+
+	fieldSeparator string
+	field          int
+
+	csv        bool
+	tsv        bool
+	csvHeader  bool
+	csvColumns rawStrings
+
+	jsonOutput bool
+	// matcher finds the matches printed by -json
+	matcher   purl.Matcher
+	jsonFiles []jsonFile
+
+	diffMode    bool
+	diffContext int
+	// changedFiles is the number of inputs that -diff found would change
+	changedFiles int
+	patchPath    string
+	patch        bytes.Buffer
+
+	reportFormat string
+	rules        []rule
+	findings     []finding
+	reportFiles  []string
+
+	jsonl       bool
+	jsonKeys    rawStrings
+	invalidJSON string
+	// inputName is the name of the input being processed, for reporting
+	// lines that are not JSON
+	inputName string
+
+	onlyMatching  bool
+	matchAll      bool
+	namedPatterns rawStrings
+
+	contextBefore   int
+	contextAfter    int
+	contextExcluded bool
+	// contextPrinted is set once lines have been printed with context
+	contextPrinted bool
+
+	recursive     bool
+	includeHidden bool
+	noIgnore      bool
+
+	includeGlobs     rawStrings
+	excludePathGlobs rawStrings
+	fileTypes        rawStrings
+
+	binaryMode   string
+	encodingName string
+	encoding     purl.Encoding
+
+	compressionName string
+	compression     purl.CompressionFormat
+
 	appVersion string
 }
 
@@ -108,230 +220,268 @@ func (c *CLI) Run(args []string) int {
 		return ExitCodeFail
 	}
 
-	var searchRe *regexp.Regexp
-	var replacement []byte
+	p, err := c.buildPipeline()
+	if err != nil {
+		fmt.Fprintf(c.errStream, "Failed to compile expressions: %s\n", err)
+		return ExitCodeFail
+	}
+
+	if len(p) == 0 {
+		return ExitCodeOK
+	}
 
-	if len(c.replaceExpr) > 0 {
-		delimiter := string(c.replaceExpr[0])
-		parts := regexp.MustCompile(regexp.QuoteMeta(delimiter)).Split(c.replaceExpr[1:], -1)
-		if len(parts) < 2 {
-			fmt.Fprintln(c.errStream, "Invalid replace expression format. Use \"@search@replace@\"")
-			return ExitCodeFail
-		}
-		searchPattern := parts[0]
-		replacementStr := unescapeString(parts[1])
-		replacement = []byte(replacementStr)
+	if !c.fromStdin {
+		for _, filePath := range c.filePaths {
+			stats, err := c.processFile(p, filePath)
+			if errors.Is(err, errBinaryFile) && c.binaryMode == binarySkip {
+				fmt.Fprintf(c.errStream, "Skipping binary file: %s\n", filePath)
+				continue
+			}
+			if cerr := (*compressedFileError)(nil); errors.As(err, &cerr) {
+				fmt.Fprintf(c.errStream, "Skipping %s: %s\n", cerr, filePath)
+				continue
+			}
+			if err != nil {
+				fmt.Fprintf(c.errStream, "Failed to process file %s: %s\n", filePath, err)
+				return ExitCodeFail
+			}
 
-		if c.ignoreCase {
-			searchPattern = "(?i)" + searchPattern
+			matched := c.printSummary(filePath, stats)
+			if c.failMode && !matched {
+				c.finishOutput()
+				fmt.Fprintf(c.errStream, "No matches found in file: %s\n", filePath)
+				return ExitCodeNoMatch
+			}
 		}
-
-		searchRe, err = regexp.Compile(searchPattern)
+	} else {
+		stats, err := c.processStream(p, stdinName, c.inputStream, c.output(), false)
 		if err != nil {
-			fmt.Fprintf(c.errStream, "Failed to compile regex pattern: %s\n", err)
+			fmt.Fprintf(c.errStream, "Failed to process files: %s\n", err)
 			return ExitCodeFail
 		}
+
+		matched := c.printSummary(stdinName, stats)
+		if c.failMode && !matched {
+			c.finishOutput()
+			fmt.Fprintln(c.errStream, "No matches found in input")
+			return ExitCodeNoMatch
+		}
 	}
 
-	var filterRes, excludeRes []*regexp.Regexp
+	if err := c.finishOutput(); err != nil {
+		fmt.Fprintf(c.errStream, "Failed to write report: %s\n", err)
+		return ExitCodeFail
+	}
 
-	if len(c.filters) > 0 || len(c.excludes) > 0 {
-		filterRes, err = compileRegexps(c.filters, c.ignoreCase)
-		if err != nil {
-			fmt.Fprintf(c.errStream, "Failed to compile regex patterns: %s\n", err)
+	if c.patchPath != "" {
+		if err := os.WriteFile(c.patchPath, c.patch.Bytes(), 0o644); err != nil {
+			fmt.Fprintf(c.errStream, "Failed to write patch: %s\n", err)
 			return ExitCodeFail
 		}
+	}
 
-		excludeRes, err = compileRegexps(c.excludes, c.ignoreCase)
-		if err != nil {
-			fmt.Fprintf(c.errStream, "Failed to compile regex patterns: %s\n", err)
-			return ExitCodeFail
-		}
+	if c.changedFiles > 0 {
+		return ExitCodeChanged
 	}
+	return ExitCodeOK
+}
 
-	if len(c.filePaths) != 0 {
-		for _, filePath := range c.filePaths {
+// finishOutput prints the summary of -json or the report of -report, which
+// cover every input.
+func (c *CLI) finishOutput() error {
+	if c.jsonOutput {
+		c.printJSONSummary()
+	}
+	return c.printReport()
+}
 
-			file, err := os.Open(filePath)
-			if err != nil {
-				fmt.Fprintf(c.errStream, "Failed to open file: %s\n", err)
-				return ExitCodeFail
-			}
-			defer file.Close()
-
-			var (
-				tmpFile      *os.File
-				originalPerm os.FileMode
-			)
-
-			if c.isOverwrite {
-				resolvedPath, err := filepath.Abs(filePath)
-				if err != nil {
-					fmt.Fprintf(c.errStream, "Failed to resolve file path: %s\n", err)
-					return ExitCodeFail
-				}
-
-				fileInfo, err := file.Stat()
-				if err != nil {
-					fmt.Fprintf(c.errStream, "Failed to stat file: %s\n", err)
-					return ExitCodeFail
-				}
-				originalPerm = fileInfo.Mode().Perm()
-
-				// temp must share the filesystem with target to allow rename
-				// defer ensures we clean up unless the process is interrupted
-				tmpFile, err = os.CreateTemp(filepath.Dir(resolvedPath), "purl")
-				if err != nil {
-					fmt.Fprintf(c.errStream, "Failed to create temp file: %s\n", err)
-					return ExitCodeFail
-				}
-
-				c.outStream = tmpFile
-			}
+// output returns where the result of the pipeline is written. Nothing but
+// the summary is printed with -count, -l and -L.
+func (c *CLI) output() io.Writer {
+	if c.countMode || c.listMatches || c.listNonMatches {
+		return io.Discard
+	}
+	return c.outStream
+}
 
-			if len(c.replaceExpr) > 0 {
-				matched, err := c.replaceProcess(searchRe, replacement, file)
-				if err != nil {
-					fmt.Fprintf(c.errStream, "Failed to process files: %s\n", err)
-					return ExitCodeFail
-				}
-
-				if c.failMode && !matched {
-					fmt.Fprintf(c.errStream, "No matches found in file: %s\n", filePath)
-					return ExitCodeNoMatch
-				}
-			}
+// printSummary prints the result of -count, -l or -L for an input, and
+// reports whether the input matched. Without these options an input matched
+// when every operation searching for something found it somewhere in the
+// input and something came out of the pipeline.
+func (c *CLI) printSummary(name string, stats purl.Stats) bool {
+	if !c.countMode && !c.listMatches && !c.listNonMatches {
+		return stats.Found
+	}
 
-			if len(c.filters) > 0 || len(c.excludes) > 0 {
-				matched, err := c.filterProcess(filterRes, excludeRes, file)
-				if err != nil {
-					fmt.Fprintf(c.errStream, "Failed to process files: %s\n", err)
-					return ExitCodeFail
-				}
-
-				if c.failMode && !matched {
-					fmt.Fprintf(c.errStream, "No matches found in file: %s\n", filePath)
-					return ExitCodeNoMatch
-				}
+	// the matches of the last operation that searches for something, or the
+	// kept lines when there are only -exclude options
+	count := stats.Output
+	if c.countStage >= 0 {
+		count = stats.Matches[c.countStage]
+	}
+
+	terminator := "\n"
+	if c.nullSeparated {
+		terminator = "\x00"
+	}
+
+	switch {
+	case c.countMode:
+		if c.withFilename {
+			sep := ":"
+			if c.nullSeparated {
+				sep = "\x00"
 			}
+			fmt.Fprintf(c.outStream, "%s%s%d\n", c.colorName(name), sep, count)
+		} else {
+			fmt.Fprintf(c.outStream, "%d\n", count)
+		}
+	case c.listMatches && count > 0, c.listNonMatches && count == 0:
+		fmt.Fprintf(c.outStream, "%s%s", c.colorName(name), terminator)
+	}
 
-			if c.isOverwrite {
-				if err := tmpFile.Close(); err != nil {
-					os.Remove(tmpFile.Name())
+	return count > 0
+}
 
-					fmt.Fprintf(c.errStream, "Failed to close temp file: %s\n", err)
-					return ExitCodeFail
-				}
+// processFile runs the pipeline over a single file and writes the result to
+// the output stream, back to the file when -overwrite is given, or to the
+// patch of -patch.
+// In fail mode the file is left untouched when nothing matched.
+func (c *CLI) processFile(p []purl.Stage, filePath string) (purl.Stats, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return purl.Stats{}, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
 
-				if err := os.Chmod(tmpFile.Name(), originalPerm); err != nil {
-					os.Remove(tmpFile.Name())
+	if c.patchPath != "" {
+		return c.patchFile(p, filePath, file)
+	}
 
-					fmt.Fprintf(c.errStream, "Failed to set file permissions: %s\n", err)
-					return ExitCodeFail
-				}
+	if !c.isOverwrite {
+		return c.processStream(p, filePath, file, c.output(), true)
+	}
 
-				if err := os.Rename(tmpFile.Name(), filePath); err != nil {
-					os.Remove(tmpFile.Name())
+	resolvedPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return purl.Stats{}, fmt.Errorf("failed to resolve file path: %w", err)
+	}
 
-					fmt.Fprintf(c.errStream, "Failed to overwrite the original file: %s\n", err)
-					return ExitCodeFail
-				}
-			}
-		}
-	} else {
-		if len(c.replaceExpr) > 0 {
-			matched, err := c.replaceProcess(searchRe, replacement, c.inputStream)
-			if err != nil {
-				fmt.Fprintf(c.errStream, "Failed to process files: %s\n", err)
-				return ExitCodeFail
-			}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return purl.Stats{}, fmt.Errorf("failed to stat file: %w", err)
+	}
+	originalPerm := fileInfo.Mode().Perm()
 
-			if c.failMode && !matched {
-				fmt.Fprintln(c.errStream, "No matches found in input")
-				return ExitCodeNoMatch
-			}
-		}
+	// temp must share the filesystem with target to allow rename
+	// defer ensures we clean up unless the process is interrupted
+	tmpFile, err := os.CreateTemp(filepath.Dir(resolvedPath), "purl")
+	if err != nil {
+		return purl.Stats{}, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
 
-		if len(c.filters) > 0 || len(c.excludes) > 0 {
-			matched, err := c.filterProcess(filterRes, excludeRes, c.inputStream)
-			if err != nil {
-				fmt.Fprintf(c.errStream, "Failed to process files: %s\n", err)
-				return ExitCodeFail
-			}
+	stats, err := c.processStream(p, filePath, file, tmpFile, true)
+	if err != nil {
+		tmpFile.Close()
+		return purl.Stats{}, err
+	}
 
-			if c.failMode && !matched {
-				fmt.Fprintln(c.errStream, "No matches found in input")
-				return ExitCodeNoMatch
-			}
-		}
+	if err := tmpFile.Close(); err != nil {
+		return purl.Stats{}, fmt.Errorf("failed to close temp file: %w", err)
 	}
 
-	if len(c.extractExpr) > 0 {
-		// Split the extract expression into pattern and replacement
-		delimiter := string(c.extractExpr[0])
-		parts := regexp.MustCompile(regexp.QuoteMeta(delimiter)).Split(c.extractExpr[1:], -1)
-		if len(parts) < 2 {
-			fmt.Fprintln(c.errStream, "Invalid extract expression format. Use \"@pattern@replacement@\"")
-			return ExitCodeFail
-		}
-		searchPattern := parts[0]
-		replacementStr := unescapeString(parts[1])
-		replacement := []byte(replacementStr)
+	if c.failMode && !stats.Found {
+		return stats, nil
+	}
+
+	if err := os.Chmod(tmpFile.Name(), originalPerm); err != nil {
+		return purl.Stats{}, fmt.Errorf("failed to set file permissions: %w", err)
+	}
+
+	if err := os.Rename(tmpFile.Name(), filePath); err != nil {
+		return purl.Stats{}, fmt.Errorf("failed to overwrite the original file: %w", err)
+	}
+
+	return stats, nil
+}
+
+// processStream decompresses and decodes the input to UTF-8 text, runs the
+// pipeline and encodes the output back to the encoding of the input.
+// For files, binary input is rejected with errBinaryFile, and with -overwrite
+// the output is compressed again in the format of the input, or the file is
+// rejected with a compressedFileError when the format cannot be written.
+func (c *CLI) processStream(p []purl.Stage, name string, inputStream io.Reader, outStream io.Writer, isFile bool) (purl.Stats, error) {
+	decompressed, err := purl.NewDecompressReader(inputStream, c.compression)
+	if err != nil {
+		return purl.Stats{}, err
+	}
+	defer decompressed.Close()
+
+	// a patch cannot be applied to compressed files
+	if isFile && c.patchPath != "" && decompressed.Format() != purl.CompressionNone {
+		return purl.Stats{}, &compressedFileError{format: decompressed.Format()}
+	}
 
-		// Add case-insensitive flag if necessary
-		if c.ignoreCase {
-			searchPattern = "(?i)" + searchPattern
+	decoded, enc, err := purl.Decode(decompressed, c.encoding)
+	if err != nil {
+		return purl.Stats{}, err
+	}
+
+	input := bufio.NewReader(decoded)
+	if isFile && c.binaryMode != binaryText {
+		// a read error is reported again by the pipeline
+		head, _ := input.Peek(purl.BinarySniffLen)
+		if purl.IsBinary(head) {
+			return purl.Stats{}, errBinaryFile
 		}
+	}
 
-		// Compile the regex pattern
-		searchRe, err := regexp.Compile(searchPattern)
+	if c.diffMode {
+		return c.diffProcess(p, name, input, outStream)
+	}
+
+	compressed := io.WriteCloser(nopCloser{outStream})
+	if isFile && c.isOverwrite {
+		compressed, err = decompressed.NewCompressWriter(outStream)
 		if err != nil {
-			fmt.Fprintf(c.errStream, "Failed to compile extract regex pattern: %s\n", err)
-			return ExitCodeFail
+			return purl.Stats{}, &compressedFileError{format: decompressed.Format()}
 		}
+	}
 
-		// Process files if provided
-		if len(c.filePaths) > 0 {
-			for _, filePath := range c.filePaths {
-				file, err := os.Open(filePath)
-				if err != nil {
-					fmt.Fprintf(c.errStream, "Failed to open file: %s\n", err)
-					return ExitCodeFail
-				}
-				defer file.Close()
-
-				// Process the file content with the extract logic
-				matched, err := c.extractProcess(searchRe, replacement, file)
-				if err != nil {
-					fmt.Fprintf(c.errStream, "Failed to process file: %s\n", err)
-					return ExitCodeFail
-				}
-
-				// Handle fail mode if no matches are found
-				if c.failMode && !matched {
-					fmt.Fprintf(c.errStream, "No matches found in file: %s\n", filePath)
-					return ExitCodeNoMatch
-				}
-			}
-		} else {
-			// Process standard input if no files are provided
-			matched, err := c.extractProcess(searchRe, replacement, c.inputStream)
-			if err != nil {
-				fmt.Fprintf(c.errStream, "Failed to process input: %s\n", err)
-				return ExitCodeFail
-			}
+	if !isFile || !(c.isOverwrite || c.patchPath != "") {
+		// only a whole file written back keeps its byte order mark
+		enc = enc.WithoutBOM()
+	}
 
-			// Handle fail mode if no matches are found
-			if c.failMode && !matched {
-				fmt.Fprintln(c.errStream, "No matches found in input")
-				return ExitCodeNoMatch
-			}
-		}
+	output := enc.Encode(compressed)
+	if c.jsonOutput || c.reportFormat != "" {
+		// JSON and reports are printed in UTF-8 like what is printed after
+		// every input, whatever the input is
+		output = nopCloser{outStream}
+	}
+	stats, err := c.pipelineProcess(p, name, input, output)
+	if err != nil {
+		return purl.Stats{}, err
+	}
 
-		return ExitCodeOK
+	if err := output.Close(); err != nil {
+		return purl.Stats{}, fmt.Errorf("error writing to output: %w", err)
 	}
 
-	return ExitCodeOK
+	if err := compressed.Close(); err != nil {
+		return purl.Stats{}, fmt.Errorf("error writing to output: %w", err)
+	}
+
+	return stats, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
 }
 
 func (c *CLI) parseFlags(args []string) (*flag.FlagSet, error) {
@@ -341,14 +491,70 @@ func (c *CLI) parseFlags(args []string) (*flag.FlagSet, error) {
 	var color, noColor bool
 
 	flags.BoolVar(&c.isOverwrite, "overwrite", false, "Replace original file with results.")
-	flags.StringVar(&c.replaceExpr, "replace", "", "Format: '@match@replacement@'.")
-	flags.StringVar(&c.extractExpr, "extract", "", "Extract and print text matching the regex pattern.")
-	flags.Var(&c.filters, "filter", "Apply search refinement.")
-	flags.Var(&c.excludes, "exclude", "Exclude lines matching regex.")
+	flags.Var(&operationFlag{operations: &c.operations, kind: operationReplace}, "replace", "Format: '@match@replacement@'. Use $1 or ${name} for capture groups.")
+	flags.Var(&operationFlag{operations: &c.operations, kind: operationExtract}, "extract", "Extract and print text matching the regex pattern.")
+	flags.Var(&operationFlag{operations: &c.operations, kind: operationFilter}, "filter", "Apply search refinement.")
+	flags.Var(&operationFlag{operations: &c.operations, kind: operationExclude}, "exclude", "Exclude lines matching regex.")
+	flags.Var(&operationFlag{operations: &c.operations, kind: operationWhere}, "where", "Keep lines satisfying a boolean expression of -p names, e.g. 'err and (db or not retry)'.")
+	flags.Var(&c.namedPatterns, "p", "Define a pattern for -where, e.g. 'err=ERROR|FATAL'.")
+	flags.StringVar(&c.rangeFrom, "from", "", "Only operate on lines from a line matching the pattern, like sed's /from/,/to/.")
+	flags.StringVar(&c.rangeAfter, "after", "", "Like -from, but without the matching line.")
+	flags.StringVar(&c.rangeTo, "to", "", "Only operate on lines up to a line matching the pattern, after -from.")
+	flags.StringVar(&c.rangeBefore, "before", "", "Like -to, but without the matching line.")
+	flags.Var(&c.guardOn, "on", "Only -replace on lines matching the pattern. Other lines are kept unchanged.")
+	flags.Var(&c.guardNotOn, "not-on", "Do not -replace on lines matching the pattern.")
+	flags.StringVar(&c.fieldSeparator, "F", "", `Split lines into fields at the separator: ' ' for blanks, a single character such as ',' or '\t', or a regex. -extract can use $f1, $f2, ...`)
+	flags.IntVar(&c.field, "field", 0, "Only -filter, -exclude, -where, -replace and -extract in field `N` of each line. Fields are split on blanks without -F.")
+	flags.BoolVar(&c.csv, "csv", false, "Parse the input as CSV records and operate on their fields. Records are written back with quoting as needed.")
+	flags.BoolVar(&c.tsv, "tsv", false, "Like -csv, but with tab separated fields.")
+	flags.BoolVar(&c.csvHeader, "header", false, "With -csv or -tsv, keep the first record unchanged and allow -column to name columns.")
+	flags.Var(&c.csvColumns, "column", "With -csv or -tsv, only operate on the column `N` or the column named in the header. Can be given more than once.")
+	flags.BoolVar(&c.jsonOutput, "json", false, "Print a JSON object for every match of the last -filter, -where or -extract, with its file, line, offset and capture groups, and a summary at the end. Input is processed line by line.")
+	flags.BoolVar(&c.diffMode, "diff", false, "Print a unified diff of the changes instead of the result, without changing anything. Exit with 1 if any input would change.")
+	flags.IntVar(&c.diffContext, "U", 3, "Print `N` lines of context around each change with -diff and -patch.")
+	flags.StringVar(&c.patchPath, "patch", "", "Write the changes to `file` as a patch for git apply or patch -p1, without changing the input files. Paths are relative to the root of the git repository.")
+	flags.StringVar(&c.reportFormat, "report", "", "Report the matches of every -filter, -where, -extract and -replace, without changing anything, as sarif, github (workflow annotations), junit or quickfix.")
+	flags.Var(&reportFlag{operations: &c.operations}, "message", "Message of -report for the matches of the preceding -filter, -where, -extract or -replace.")
+	flags.Var(&reportFlag{operations: &c.operations, severity: true}, "severity", "Severity of -report for the matches of the preceding -filter, -where, -extract or -replace: error, warning or note. Default error.")
+	flags.BoolVar(&c.jsonl, "jsonl", false, "Parse each line as JSON and operate on the values of -key instead of the raw line.")
+	flags.Var(&c.jsonKeys, "key", "With -jsonl, only operate on the value at the `path`, e.g. '.request.path' or '.items[0].id'. Can be given more than once.")
+	flags.StringVar(&c.invalidJSON, "invalid-json", invalidJSONPass, "With -jsonl, how to handle lines that are not JSON: pass to keep them unchanged with -replace and -exclude (other operations drop them), or report to also print a warning.")
+	flags.Var(&c.lineSpecs, "lines", "Only operate on the given lines, e.g. '1', '10:20', '-5:' for the last five or '1,3:4'.")
+	flags.BoolVar(&c.matchAll, "all", false, "Keep only lines matching every -filter instead of any.")
+	flags.Var(&scriptFlag{operations: &c.operations}, "f", "Read replace, filter, exclude and extract commands from a script file.")
+	flags.BoolVar(&c.onlyMatching, "o", false, "Print only the text matched by -filter, each match on its own line.")
+	flags.BoolVar(&c.onlyMatching, "only-matching", false, "Print only the text matched by -filter, each match on its own line.")
+	var contextAround int
+	flags.IntVar(&c.contextAfter, "A", 0, "Print `N` lines of context after each line matched by -filter.")
+	flags.IntVar(&c.contextBefore, "B", 0, "Print `N` lines of context before each line matched by -filter.")
+	flags.IntVar(&contextAround, "C", 0, "Print `N` lines of context before and after each line matched by -filter.")
+	flags.BoolVar(&c.contextExcluded, "context-excluded", false, "Allow lines removed by -exclude to be printed as context.")
+	flags.BoolVar(&c.countMode, "count", false, "Only print the number of matches of each input: lines for -filter, replacements for -replace and matches for -extract.")
+	flags.BoolVar(&c.listMatches, "l", false, "Only print the names of inputs with matches.")
+	flags.BoolVar(&c.listMatches, "files-with-matches", false, "Only print the names of inputs with matches.")
+	flags.BoolVar(&c.listNonMatches, "L", false, "Only print the names of inputs without matches.")
+	flags.BoolVar(&c.listNonMatches, "files-without-match", false, "Only print the names of inputs without matches.")
+	flags.BoolVar(&c.nullSeparated, "0", false, "Terminate file names printed by -l and -L with a NUL byte, for xargs -0.")
+	flags.BoolVar(&c.lineNumber, "n", false, "Prefix each output line with its line number.")
+	flags.BoolVar(&c.byteOffset, "b", false, "Prefix each output line with its byte offset in the input.")
+	flags.BoolVar(&c.withFilename, "H", false, "Prefix each output line with the file name. Default when processing more than one file.")
+	flags.BoolVar(&c.noFilename, "no-filename", false, "Never prefix output lines with the file name.")
 	flags.BoolVar(&color, "color", false, "Colored output. Default auto.")
 	flags.BoolVar(&noColor, "no-color", false, "Disable colored output.")
+	flags.BoolVar(&c.recursive, "r", false, "Process files in directories recursively.")
+	flags.BoolVar(&c.recursive, "recursive", false, "Process files in directories recursively.")
+	flags.BoolVar(&c.includeHidden, "hidden", false, "Include hidden files and directories with -r. .git is always skipped.")
+	flags.BoolVar(&c.noIgnore, "no-ignore", false, "Do not honor .gitignore, .ignore and .purlignore files with -r.")
+	flags.Var(&c.includeGlobs, "include", "Only process files matching the glob, e.g. '*.go'.")
+	flags.Var(&c.excludePathGlobs, "exclude-path", "Skip files matching the glob, e.g. 'vendor/**'.")
+	flags.Var(&c.fileTypes, "type", "Only process files of the comma separated types, e.g. 'go,yaml'.")
+	flags.StringVar(&c.binaryMode, "binary", binarySkip, "How to handle binary files: skip, text or error. Binary files are only overwritten with text.")
+	flags.StringVar(&c.encodingName, "encoding", "", "Character encoding of the input, e.g. shift_jis, euc-jp or utf-16le. Output is written in the same encoding. Default UTF-8, or detected from a byte order mark.")
+	flags.StringVar(&c.compressionName, "compression", string(purl.CompressionAuto), "Compression of the input: auto, none, gzip, bzip2 or zlib. auto detects it from the magic bytes.")
+	flags.StringVar(&c.compressionName, "z", string(purl.CompressionAuto), "Shorthand for -compression.")
 	flags.BoolVar(&c.ignoreCase, "i", false, `Ignore case (prefixes '(?i)' to all regular expressions)`)
 	flags.BoolVar(&c.lineMode, "line", false, "Process input line by line")
+	flags.BoolVar(&c.chomp, "chomp", false, `Match each line without its terminator (\n or \r\n) and write the terminator back unchanged. Implies -line.`)
 	flags.BoolVar(&c.failMode, "fail", false, "Exit with a non-zero status if no matches are found")
 	flags.BoolVar(&c.help, "help", false, `Show help`)
 	flags.BoolVar(&c.version, "version", false, "Print version and quit")
@@ -363,7 +569,18 @@ func (c *CLI) parseFlags(args []string) (*flag.FlagSet, error) {
 		return nil, fmt.Errorf("failed to parse flags: %w", err)
 	}
 
-	c.isColor = !noColor && (color || c.isStdoutTerminal)
+	// -A and -B take precedence over -C
+	given := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if !given["A"] {
+		c.contextAfter = contextAround
+	}
+	if !given["B"] {
+		c.contextBefore = contextAround
+	}
+
+	// never write escape sequences into files
+	c.isColor = !noColor && !c.isOverwrite && c.patchPath == "" && (color || c.isStdoutTerminal)
 
 	if c.isStdinTerminal {
 		c.lineMode = true
@@ -373,241 +590,303 @@ func (c *CLI) parseFlags(args []string) (*flag.FlagSet, error) {
 }
 
 func (c *CLI) validateInput(flags *flag.FlagSet) error {
-	if flags.NArg() == 0 && c.isStdinTerminal {
+	paths := flags.Args()
+	if len(paths) == 0 && c.recursive {
+		// walk the current directory like other recursive search tools
+		paths = []string{"."}
+	}
+
+	if len(paths) == 0 && c.isStdinTerminal {
 		return fmt.Errorf("no input file specified")
 	}
 
-	if flags.NArg() == 0 && c.isOverwrite {
+	if len(paths) == 0 && c.isOverwrite {
 		return fmt.Errorf("cannot use -overwrite option with stdin")
 	}
 
-	err := c.validateMutuallyExclusiveOptions()
-	if err != nil {
-		return err
+	switch c.binaryMode {
+	case binarySkip, binaryText, binaryError:
+	default:
+		return fmt.Errorf("invalid -binary value %q. Use skip, text or error", c.binaryMode)
 	}
 
-	if err := c.validateExpressionFormats(); err != nil {
+	compression, err := purl.ParseCompressionFormat(c.compressionName)
+	if err != nil {
 		return err
 	}
+	c.compression = compression
 
-	if flags.NArg() > 0 {
-		c.filePaths = flags.Args()
-		for _, filePath := range c.filePaths {
-			if _, err := os.Stat(filePath); os.IsNotExist(err) {
-				return fmt.Errorf("input file does not exist: %s", filePath)
-			}
+	c.encoding = purl.UTF8
+	if c.encodingName != "" {
+		enc, err := purl.LookupEncoding(c.encodingName)
+		if err != nil {
+			return err
 		}
+		c.encoding = enc
 	}
 
-	return nil
-}
+	if c.isOverwrite && (c.lineNumber || c.byteOffset || c.withFilename) {
+		return fmt.Errorf("cannot use -n, -b or -H with -overwrite")
+	}
 
-// validateMutuallyExclusiveOptions checks that incompatible options are not used together
-func (c *CLI) validateMutuallyExclusiveOptions() error {
-	if len(c.extractExpr) > 0 {
-		if len(c.replaceExpr) > 0 || len(c.filters) > 0 || len(c.excludes) > 0 {
-			return fmt.Errorf("-extract cannot be used with -replace, -filter, or -exclude options")
+	modes := 0
+	for _, m := range []bool{c.countMode, c.listMatches, c.listNonMatches} {
+		if m {
+			modes++
 		}
 	}
-
-	if len(c.replaceExpr) > 0 && (len(c.filters) > 0 || len(c.excludes) > 0 || len(c.extractExpr) > 0) {
-		return fmt.Errorf("-replace cannot be used with -filter, -exclude, or -extract options")
+	if modes > 1 {
+		return fmt.Errorf("cannot use -count, -l and -L together")
+	}
+	if modes > 0 && c.isOverwrite {
+		return fmt.Errorf("cannot use -count, -l or -L with -overwrite")
 	}
 
-	return nil
-}
+	if c.rangeFrom != "" && c.rangeAfter != "" {
+		return fmt.Errorf("cannot use -from and -after together")
+	}
+	if c.rangeTo != "" && c.rangeBefore != "" {
+		return fmt.Errorf("cannot use -to and -before together")
+	}
 
-// validateExpressionFormats checks the format of expressions
-func (c *CLI) validateExpressionFormats() error {
-	// Validate -replace expression format
-	if len(c.replaceExpr) > 0 && len(c.replaceExpr) < 3 {
-		return fmt.Errorf("invalid replace expression format. Use \"@search@replace@\"")
+	if c.field < 0 {
+		return fmt.Errorf("-field must not be negative")
 	}
 
-	// Validate -extract expression format
-	if len(c.extractExpr) > 0 && len(c.extractExpr) < 3 {
-		return fmt.Errorf("invalid extract expression format. Use \"@search@replace@\"")
+	if len(c.guardOn)+len(c.guardNotOn) > 0 && !slices.ContainsFunc(c.operations, func(op operation) bool { return op.kind == operationReplace }) {
+		return fmt.Errorf("-on and -not-on require -replace")
 	}
 
-	return nil
-}
+	if err := c.validateContext(); err != nil {
+		return err
+	}
 
-// replaceProcess reads data from inputStream, performs a regex replacement,
-// and writes the modified data to outputStream.
-// If input is from a pipe, it processes input line by line without changing newline characters.
-// If input is from a file, it reads and processes the entire file at once.
-func (c *CLI) replaceProcess(searchRe *regexp.Regexp, replacement []byte, inputStream io.Reader) (bool, error) {
-	matched := false
-	if !c.lineMode {
-		// Read all data from the file input
-		b, err := io.ReadAll(inputStream)
-		if err != nil {
-			return false, fmt.Errorf("error reading file: %w", err)
-		}
+	if err := c.validateCSV(); err != nil {
+		return err
+	}
 
-		modified := searchRe.ReplaceAllFunc(b, func(match []byte) []byte {
-			matched = true
-			return replacement
-		})
-		c.outStream.Write(modified)
-	} else {
-		// Read input line by line when input is from a pipe without changing newline characters
-		reader := bufio.NewReader(inputStream)
-		for {
-			line, err := reader.ReadBytes('\n')
+	if err := c.validateJSONL(); err != nil {
+		return err
+	}
 
-			if err != nil && !errors.Is(err, io.EOF) {
-				return false, fmt.Errorf("error reading input: %w", err)
-			}
+	if err := c.validateReport(); err != nil {
+		return err
+	}
 
-			if errors.Is(err, io.EOF) && len(line) == 0 {
-				break
-			}
+	if err := c.validateDiff(); err != nil {
+		return err
+	}
 
-			// Replace text in each line using the regex
-			modifiedLine := searchRe.ReplaceAllFunc(line, func(match []byte) []byte {
-				matched = true
-				return replacement
-			})
+	if err := c.validatePatch(paths); err != nil {
+		return err
+	}
 
-			// Write the changed line to the output
-			if _, err := c.outStream.Write(modifiedLine); err != nil {
-				return false, fmt.Errorf("error writing to output: %w", err)
-			}
+	if c.jsonOutput {
+		if !c.searches() {
+			return fmt.Errorf("-json requires -filter, -where or -extract")
+		}
+		if c.isOverwrite || c.countMode || c.listMatches || c.listNonMatches || c.onlyMatching ||
+			c.contextBefore > 0 || c.contextAfter > 0 || c.lineNumber || c.byteOffset || c.withFilename ||
+			c.csvComma() != 0 || c.jsonl {
+			return fmt.Errorf("cannot use -overwrite, -count, -l, -L, -o, -A, -B, -C, -n, -b, -H, -csv, -tsv or -jsonl with -json")
 		}
 	}
 
-	return matched, nil
-}
+	if err := c.validateExpressionFormats(); err != nil {
+		return err
+	}
 
-func (c *CLI) filterProcess(filters []*regexp.Regexp, excludes []*regexp.Regexp, inputStream io.Reader) (bool, error) {
-	matched := false
-	// Read input line by line when input is from a pipe without changing newline characters
-	reader := bufio.NewReader(inputStream)
-	for {
-		line, err := reader.ReadBytes('\n')
+	c.fromStdin = len(paths) == 0
 
-		if err != nil && !errors.Is(err, io.EOF) {
-			return false, fmt.Errorf("error reading input: %w", err)
+	for _, filePath := range paths {
+		fileInfo, err := os.Stat(filePath)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("input file does not exist: %s", filePath)
 		}
 
-		if errors.Is(err, io.EOF) && len(line) == 0 {
-			break
+		if err == nil && fileInfo.IsDir() && !c.recursive {
+			return fmt.Errorf("input file is a directory: %s (use -r to process directories)", filePath)
 		}
+	}
 
-		hit, hitRes := matchesFilters(line, filters)
-		if len(filters) == 0 || hit {
-			matched = hit
-			if excludeHit, _ := matchesFilters(line, excludes); !excludeHit {
-				if len(hitRes) > 0 && c.isColor {
-					line = colorText(line, hitRes)
-				}
-
-				if _, err := c.outStream.Write(line); err != nil {
-					return false, fmt.Errorf("error writing to output: %w", err)
-				}
-			}
+	if c.recursive {
+		files, err := c.collectFiles(paths)
+		if err != nil {
+			return fmt.Errorf("failed to collect files: %w", err)
 		}
+		paths = files
 	}
 
-	return matched, nil
+	paths, err = c.selectFiles(paths)
+	if err != nil {
+		return err
+	}
+	c.filePaths = paths
+
+	// like grep, search results from several files show where they come from
+	if !c.isOverwrite && !c.diffMode && c.patchPath == "" && c.csvComma() == 0 && (len(c.filePaths) > 1 || c.recursive) && (c.searches() || c.countMode) {
+		c.withFilename = true
+	}
+	if c.noFilename {
+		c.withFilename = false
+	}
+
+	return nil
 }
 
-func (c *CLI) extractProcess(searchRe *regexp.Regexp, replacement []byte, inputStream io.Reader) (bool, error) {
-	matched := false
-	replacementStr := string(replacement)
+// searches reports whether the operations select text with -filter or
+// -extract rather than only rewriting it.
+func (c *CLI) searches() bool {
+	for _, op := range c.operations {
+		if op.isFilter() || op.kind == operationExtract {
+			return true
+		}
+	}
+	return false
+}
 
-	if c.lineMode {
-		reader := bufio.NewReader(inputStream)
-		for {
-			line, err := reader.ReadBytes('\n')
-			if err != nil && !errors.Is(err, io.EOF) {
-				return false, fmt.Errorf("error reading input: %w", err)
-			}
+// validateContext checks the -A, -B, -C and -o options
+func (c *CLI) validateContext() error {
+	if c.contextBefore < 0 || c.contextAfter < 0 {
+		return fmt.Errorf("the number of context lines must not be negative")
+	}
 
-			if errors.Is(err, io.EOF) && len(line) == 0 {
-				break
-			}
+	hasFilter := false
+	for _, op := range c.operations {
+		if op.isFilter() {
+			hasFilter = true
+		}
+	}
 
-			matches := searchRe.FindAllSubmatch(line, -1)
-			for _, match := range matches {
-				matched = true
+	if c.onlyMatching && !hasFilter {
+		return fmt.Errorf("-o requires -filter")
+	}
 
-				replacements := make([]string, 0, 2*len(match))
-				for i := len(match) - 1; i >= 0; i-- {
-					replacements = append(replacements, fmt.Sprintf("$%d", i), string(match[i]))
-				}
+	if (c.contextBefore > 0 || c.contextAfter > 0) && !hasFilter {
+		return fmt.Errorf("-A, -B and -C require -filter")
+	}
 
-				result := strings.NewReplacer(replacements...).Replace(replacementStr)
+	return nil
+}
 
-				if _, err := fmt.Fprintln(c.outStream, result); err != nil {
-					return false, fmt.Errorf("error writing to output: %w", err)
-				}
-			}
+// validateCSV checks the options that cannot be used with records of -csv and
+// -tsv.
+func (c *CLI) validateCSV() error {
+	if c.csv && c.tsv {
+		return fmt.Errorf("cannot use -csv and -tsv together")
+	}
 
-			if errors.Is(err, io.EOF) {
-				break
-			}
-		}
-	} else {
-		b, err := io.ReadAll(inputStream)
-		if err != nil {
-			return false, fmt.Errorf("error reading file: %w", err)
+	if c.csvComma() == 0 {
+		if c.csvHeader || len(c.csvColumns) > 0 {
+			return fmt.Errorf("-header and -column require -csv or -tsv")
 		}
+		return nil
+	}
 
-		matches := searchRe.FindAllSubmatch(b, -1)
-		for _, match := range matches {
-			matched = true
+	if c.fieldSeparator != "" || c.field != 0 || c.chomp || c.onlyMatching ||
+		c.contextBefore > 0 || c.contextAfter > 0 || c.lineNumber || c.byteOffset || c.withFilename {
+		return fmt.Errorf("cannot use -F, -field, -chomp, -o, -A, -B, -C, -n, -b or -H with -csv or -tsv")
+	}
 
-			// Construct replacements for placeholders dynamically
-			replacements := make([]string, 0, 2*len(match))
-			for i := len(match) - 1; i >= 0; i-- { // Start from the largest index
-				replacements = append(replacements, fmt.Sprintf("$%d", i), string(match[i]))
-			}
+	if c.rangeFrom != "" || c.rangeAfter != "" || c.rangeTo != "" || c.rangeBefore != "" || len(c.lineSpecs) > 0 ||
+		len(c.guardOn) > 0 || len(c.guardNotOn) > 0 {
+		return fmt.Errorf("cannot use -from, -after, -to, -before, -lines, -on or -not-on with -csv or -tsv")
+	}
 
-			// Apply the replacements
-			result := strings.NewReplacer(replacements...).Replace(replacementStr)
+	for _, col := range c.csvColumns {
+		if _, err := strconv.Atoi(col); err != nil && !c.csvHeader {
+			return fmt.Errorf("-column %q names a column, which requires -header", col)
+		}
+	}
 
-			// Write the result with error checking
-			if _, err := fmt.Fprintln(c.outStream, result); err != nil {
-				return false, fmt.Errorf("error writing to output: %w", err)
-			}
+	for i, op := range c.operations {
+		if op.kind == operationExtract && i != len(c.operations)-1 {
+			return fmt.Errorf("-extract must be the last operation with -csv or -tsv")
 		}
 	}
 
-	return matched, nil
+	return nil
 }
 
-func compileRegexps(rawPatterns []string, ignoreCase bool) ([]*regexp.Regexp, error) {
-	regexps := make([]*regexp.Regexp, 0, len(rawPatterns))
-	for _, pattern := range rawPatterns {
-		if ignoreCase {
-			pattern = "(?im)" + pattern
-		} else {
-			pattern = "(?m)" + pattern
+// validateReport checks the options of -report.
+func (c *CLI) validateReport() error {
+	switch c.reportFormat {
+	case "":
+		return nil
+	case reportSARIF, reportGitHub, reportJUnit, reportQuickfix:
+	default:
+		return fmt.Errorf("invalid -report value %q. Use %q, %q, %q or %q", c.reportFormat, reportSARIF, reportGitHub, reportJUnit, reportQuickfix)
+	}
+
+	if !slices.ContainsFunc(c.operations, func(op operation) bool { return op.kind != operationExclude }) {
+		return fmt.Errorf("-report requires -filter, -where, -extract or -replace")
+	}
+
+	if c.isOverwrite || c.countMode || c.listMatches || c.listNonMatches || c.onlyMatching ||
+		c.contextBefore > 0 || c.contextAfter > 0 || c.lineNumber || c.byteOffset || c.withFilename ||
+		c.csvComma() != 0 || c.jsonl || c.jsonOutput || len(c.guardOn) > 0 || len(c.guardNotOn) > 0 {
+		return fmt.Errorf("cannot use -overwrite, -count, -l, -L, -o, -A, -B, -C, -n, -b, -H, -csv, -tsv, -jsonl, -json, -on or -not-on with -report")
+	}
+
+	return nil
+}
+
+// validateJSONL checks the options of -jsonl.
+func (c *CLI) validateJSONL() error {
+	if c.invalidJSON != invalidJSONPass && c.invalidJSON != invalidJSONReport {
+		return fmt.Errorf("invalid -invalid-json value %q. Use %q or %q", c.invalidJSON, invalidJSONPass, invalidJSONReport)
+	}
+
+	if !c.jsonl {
+		if len(c.jsonKeys) > 0 {
+			return fmt.Errorf("-key requires -jsonl")
 		}
-		re, err := regexp.Compile(pattern)
-		if err != nil {
-			return nil, fmt.Errorf("invalid regex pattern: %w", err)
+		return nil
+	}
+
+	if len(c.jsonKeys) == 0 {
+		return fmt.Errorf("-jsonl requires -key")
+	}
+
+	if c.csvComma() != 0 || c.fieldSeparator != "" || c.field != 0 || c.onlyMatching ||
+		c.contextBefore > 0 || c.contextAfter > 0 || len(c.guardOn) > 0 || len(c.guardNotOn) > 0 {
+		return fmt.Errorf("cannot use -csv, -tsv, -F, -field, -o, -A, -B, -C, -on or -not-on with -jsonl")
+	}
+
+	for i, op := range c.operations {
+		if op.kind == operationExtract && i != len(c.operations)-1 {
+			return fmt.Errorf("-extract must be the last operation with -jsonl")
 		}
-		regexps = append(regexps, re)
 	}
-	return regexps, nil
+
+	return nil
 }
 
-func matchesFilters(line []byte, regexps []*regexp.Regexp) (bool, []*regexp.Regexp) {
-	var matchedRegexps []*regexp.Regexp
-	for _, re := range regexps {
-		if re.Match(line) {
-			matchedRegexps = append(matchedRegexps, re)
-		}
+// csvComma returns the field delimiter of -csv or -tsv, or 0 for text input.
+func (c *CLI) csvComma() rune {
+	switch {
+	case c.csv:
+		return ','
+	case c.tsv:
+		return '\t'
 	}
-	return len(matchedRegexps) > 0, matchedRegexps
+	return 0
 }
 
-func colorText(line []byte, res []*regexp.Regexp) []byte {
-	for _, re := range res {
-		line = re.ReplaceAll(line, []byte("\x1b[1m\x1b[91m$0\x1b[0m"))
+// validateExpressionFormats checks the format of expressions
+func (c *CLI) validateExpressionFormats() error {
+	for _, op := range c.operations {
+		switch op.kind {
+		case operationReplace:
+			if len(op.expr) < 3 {
+				return fmt.Errorf("invalid replace expression format. Use \"@search@replace@\"")
+			}
+		case operationExtract:
+			if len(op.expr) < 3 {
+				return fmt.Errorf("invalid extract expression format. Use \"@search@replace@\"")
+			}
+		}
 	}
-	return line
+
+	return nil
 }
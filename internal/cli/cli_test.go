@@ -2,6 +2,10 @@ package cli_test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -9,6 +13,7 @@ import (
 	"testing"
 
 	"github.com/catatsuy/purl/internal/cli"
+	"golang.org/x/text/encoding/japanese"
 )
 
 func TestNewCLI(t *testing.T) {
@@ -65,7 +70,7 @@ func TestRun_successProcess(t *testing.T) {
 		},
 		"provide multiple files for filter": {
 			args:     []string{"purl", "-filter", "search", "testdata/test.txt", "testdata/testa.txt"},
-			expected: "searcha searchb\nsearchc searchd\n",
+			expected: "testdata/test.txt:searcha searchb\ntestdata/testa.txt:searchc searchd\n",
 		},
 		"color text": {
 			args:     []string{"purl", "-filter", "search", "-color"},
@@ -112,6 +117,74 @@ func TestRun_successProcess(t *testing.T) {
 			input:    "searchb\r\nreplace\r\nsearchcabcdefg\r\n",
 			expected: "searchb\r\nsearchcabcdefg\r\n",
 		},
+		"replace with numbered capture groups": {
+			args:     []string{"purl", "-replace", `@(\w+)=(\w+)@$2=$1@`},
+			input:    "key=value\nfoo=bar baz=qux\n",
+			expected: "value=key\nbar=foo qux=baz\n",
+		},
+		"replace with named capture groups": {
+			args:     []string{"purl", "-replace", `@(?P<key>\w+)=(?P<value>\w+)@${value}:${key}@`},
+			input:    "key=value\n",
+			expected: "value:key\n",
+		},
+		"replace with literal dollar": {
+			args:     []string{"purl", "-replace", `@price (\d+)@$$${1}.00@`},
+			input:    "price 10\n",
+			expected: "$10.00\n",
+		},
+		"replace with capture groups in line mode": {
+			args:     []string{"purl", "-line", "-replace", `@(\w+)=(\w+)@$2=$1@`},
+			input:    "key=value\nfoo=bar\n",
+			expected: "value=key\nbar=foo\n",
+		},
+		"replace with capture groups across lines": {
+			args:     []string{"purl", "-replace", `@(\w+)\n(\w+)@$2 $1@`},
+			input:    "first\nsecond\n",
+			expected: "second first\n",
+		},
+		"filter then replace": {
+			args:     []string{"purl", "-filter", "ERROR", "-replace", `@\d{4}-\d\d-\d\d@DATE@`},
+			input:    "2024-01-02 INFO ok\n2024-01-02 ERROR db\n2024-01-03 ERROR healthcheck\n",
+			expected: "DATE ERROR db\nDATE ERROR healthcheck\n",
+		},
+		"filter, replace, exclude and extract in order": {
+			args:     []string{"purl", "-filter", "ERROR", "-replace", `@\d{4}-\d\d-\d\d@DATE@`, "-exclude", "healthcheck", "-extract", `@(\w+) ERROR (\w+)@$2 at $1@`},
+			input:    "2024-01-02 INFO ok\n2024-01-02 ERROR db\n2024-01-03 ERROR healthcheck\n",
+			expected: "db at DATE\n",
+		},
+		"replace then filter matches replaced text": {
+			args:     []string{"purl", "-replace", "@foo@bar@", "-filter", "bar"},
+			input:    "foo\nbaz\n",
+			expected: "bar\n",
+		},
+		"filter then replace in line mode": {
+			args:     []string{"purl", "-line", "-filter", "a", "-replace", "@a@b@"},
+			input:    "a1\nc2\na3\n",
+			expected: "b1\nb3\n",
+		},
+		"extract then filter": {
+			args:     []string{"purl", "-extract", `@id=(\d+)@$1@`, "-filter", "^1"},
+			input:    "id=12 id=20\nid=13\n",
+			expected: "12\n13\n",
+		},
+		"pipeline colors only the last filter": {
+			args:     []string{"purl", "-color", "-filter", "a", "-replace", "@a@b@"},
+			input:    "a1\nc2\n",
+			expected: "b1\n",
+		},
+		"script file": {
+			args:     []string{"purl", "-f", "testdata/script.purl", "testdata/test_log.txt"},
+			expected: "db timeout (02/01/2024)\ncache miss (04/01/2024)\n",
+		},
+		"script file after options": {
+			args:     []string{"purl", "-replace", "@cache@CACHE@", "-f", "testdata/script.purl", "testdata/test_log.txt"},
+			expected: "db timeout (02/01/2024)\nCACHE miss (04/01/2024)\n",
+		},
+		"script file in line mode": {
+			args:     []string{"purl", "-line", "-f", "testdata/script.purl"},
+			input:    "2024-01-02 ERROR db timeout\n2024-01-03 error healthcheck\n",
+			expected: "db timeout (02/01/2024)\n",
+		},
 		"replace with special characters": {
 			args:     []string{"purl", "-replace", "@search@re\\nplace@"},
 			input:    "searchb searchc\n",
@@ -183,6 +256,10 @@ func TestRun_successProcess(t *testing.T) {
 		},
 		"provide multiple files for extract": {
 			args:     []string{"purl", "-extract", "@quick ([a-z]+) fox@animal: $1@", "testdata/test_extract.txt", "testdata/test_extract2.txt"},
+			expected: "testdata/test_extract.txt:animal: brown\ntestdata/test_extract.txt:animal: red\ntestdata/test_extract2.txt:animal: green\ntestdata/test_extract2.txt:animal: blue\n",
+		},
+		"provide multiple files for extract without file names": {
+			args:     []string{"purl", "-no-filename", "-extract", "@quick ([a-z]+) fox@animal: $1@", "testdata/test_extract.txt", "testdata/test_extract2.txt"},
 			expected: "animal: brown\nanimal: red\nanimal: green\nanimal: blue\n",
 		},
 	}
@@ -235,7 +312,7 @@ func TestRun_successProcessOnTerminal(t *testing.T) {
 		},
 		"provide multiple files for filter": {
 			args:     []string{"purl", "-filter", "search", "testdata/test.txt", "testdata/testa.txt"},
-			expected: "\x1b[1m\x1b[91msearch\x1b[0ma \x1b[1m\x1b[91msearch\x1b[0mb\n\x1b[1m\x1b[91msearch\x1b[0mc \x1b[1m\x1b[91msearch\x1b[0md\n",
+			expected: "\x1b[35mtestdata/test.txt\x1b[0m\x1b[36m:\x1b[0m\x1b[1m\x1b[91msearch\x1b[0ma \x1b[1m\x1b[91msearch\x1b[0mb\n\x1b[35mtestdata/testa.txt\x1b[0m\x1b[36m:\x1b[0m\x1b[1m\x1b[91msearch\x1b[0mc \x1b[1m\x1b[91msearch\x1b[0md\n",
 		},
 	}
 
@@ -359,6 +436,39 @@ func TestRun_FailMode(t *testing.T) {
 			expected:     "",
 			expectedCode: 1,
 		},
+		"pipeline match": {
+			args:         []string{"purl", "-filter", "ERROR", "-replace", "@db@DB@", "-fail"},
+			input:        "ERROR db\nINFO ok\n",
+			expectedCode: 0,
+		},
+		"pipeline filter matches but replace does not": {
+			args:         []string{"purl", "-filter", "ERROR", "-replace", "@db@DB@", "-fail"},
+			input:        "ERROR cache\nINFO db\n",
+			expectedCode: 1,
+		},
+		"pipeline replace matches only excluded lines": {
+			args:         []string{"purl", "-line", "-replace", "@db@DB@", "-exclude", "DB", "-fail"},
+			input:        "ERROR db\n",
+			expectedCode: 1,
+		},
+		"pipeline matches on different lines": {
+			args:  []string{"purl", "-replace", "@foo@bar@", "-filter", "ERROR", "-fail"},
+			input: "foo\nERROR\n",
+		},
+		"pipeline matches on different lines in line mode": {
+			args:  []string{"purl", "-line", "-replace", "@foo@bar@", "-filter", "ERROR", "-fail"},
+			input: "foo\nERROR\n",
+		},
+		"pipeline step without a match": {
+			args:         []string{"purl", "-replace", "@zzz@bar@", "-filter", "ERROR", "-fail"},
+			input:        "foo\nERROR\n",
+			expectedCode: 1,
+		},
+		"pipeline step without a match in line mode": {
+			args:         []string{"purl", "-line", "-replace", "@zzz@bar@", "-filter", "ERROR", "-fail"},
+			input:        "foo\nERROR\n",
+			expectedCode: 1,
+		},
 	}
 
 	for name, test := range tests {
@@ -455,6 +565,13 @@ func TestRun_successForOverwrite(t *testing.T) {
 			expected:     "replacemente replacementf\nnot not not\n",
 			expectedCode: 0,
 		},
+		{
+			desc:         "-overwrite with -filter and -replace pipeline",
+			args:         []string{"purl", "-filter", "search", "-replace", "@search(\\w)@$1@", "-overwrite", "testdata/test_for_overwrite.txt"},
+			filename:     "test_for_overwrite.txt",
+			expected:     "e f\n",
+			expectedCode: 0,
+		},
 		{
 			desc:         "-overwrite and -filter option",
 			args:         []string{"purl", "-filter", "search", "-overwrite", "testdata/test_for_overwrite.txt"},
@@ -604,8 +721,8 @@ func TestRun_failToProvideStdin(t *testing.T) {
 			expectedCode: 2,
 		},
 		{
-			desc:         "fail to provide -filter and -replace",
-			args:         []string{"purl", "-filter", "aaa", "-replace", "@search@replacement@"},
+			desc:         "fail to provide -filter and invalid -replace",
+			args:         []string{"purl", "-filter", "aaa", "-replace", "@search"},
 			expectedCode: 2,
 		},
 		{
@@ -633,6 +750,95 @@ func TestRun_failToProvideStdin(t *testing.T) {
 	}
 }
 
+func TestRun_invalidScript(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		args     []string
+		expected string
+	}{
+		{
+			desc:     "unknown command",
+			args:     []string{"purl", "-f", "testdata/script_invalid.purl"},
+			expected: "testdata/script_invalid.purl:2: unknown command \"substitute\"",
+		},
+		{
+			desc:     "non-existent script",
+			args:     []string{"purl", "-f", "testdata/noexist.purl"},
+			expected: "failed to open script file",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			t.Parallel()
+			outStream, errStream, inputStream := new(bytes.Buffer), new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, inputStream, false, false)
+
+			if got := cl.Run(tc.args); got != cli.ExitCodeParseFlagError {
+				t.Fatalf("Expected exit code %d, but got %d; error: %q", cli.ExitCodeParseFlagError, got, errStream.String())
+			}
+
+			if !strings.Contains(errStream.String(), tc.expected) {
+				t.Errorf("Error=%q, want to contain %q", errStream.String(), tc.expected)
+			}
+		})
+	}
+}
+
+func TestParseScript(t *testing.T) {
+	tests := map[string]struct {
+		script    string
+		wantExprs []string
+		wantError bool
+	}{
+		"commands and comments": {
+			script:    "# comment\n\nfilter ERROR\nreplace @a@b@\r\n",
+			wantExprs: []string{"ERROR", "@a@b@"},
+		},
+		"flags": {
+			script:    "exclude -i debug\nfilter -- -v\n",
+			wantExprs: []string{"debug", "-v"},
+		},
+		"pattern with spaces": {
+			script:    "filter   connection refused\n",
+			wantExprs: []string{"connection refused"},
+		},
+		"unknown flag": {
+			script:    "filter -x a\n",
+			wantError: true,
+		},
+		"missing argument": {
+			script:    "filter\n",
+			wantError: true,
+		},
+		"invalid expression": {
+			script:    "replace @a\n",
+			wantError: true,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			exprs, err := cli.ParseScript(strings.NewReader(tt.script))
+			if tt.wantError {
+				if err == nil {
+					t.Errorf("expected an error but got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if strings.Join(exprs, "\x00") != strings.Join(tt.wantExprs, "\x00") {
+				t.Errorf("exprs = %q, want %q", exprs, tt.wantExprs)
+			}
+		})
+	}
+}
+
 func TestRun_failToProvideFiles(t *testing.T) {
 	testCases := []struct {
 		desc         string
@@ -737,6 +943,27 @@ func TestReplaceProcess_noMatch(t *testing.T) {
 	}
 }
 
+func TestReplaceProcess_captureGroups(t *testing.T) {
+	outStream, errStream, inputStream := new(bytes.Buffer), new(bytes.Buffer), new(bytes.Buffer)
+	cl := cli.NewCLI(outStream, errStream, inputStream, false, false)
+
+	inputStream.WriteString("user=alice id=1\n")
+
+	matched, err := cl.ReplaceProcess(regexp.MustCompile(`(?P<k>\w+)=(\w+)`), []byte("$2<-${k}"), inputStream)
+	if err != nil {
+		t.Errorf("Error=%q", err)
+	}
+
+	if !matched {
+		t.Errorf("Expected to match, but not matched")
+	}
+
+	expected := "alice<-user 1<-id\n"
+	if outStream.String() != expected {
+		t.Errorf("Output=%q, want %q; error: %q", outStream.String(), expected, errStream.String())
+	}
+}
+
 func TestCompileRegexps(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -903,151 +1130,2214 @@ func TestFilterProcess(t *testing.T) {
 	}
 }
 
-func TestRun_ExtractWithFail(t *testing.T) {
+func TestRun_context(t *testing.T) {
 	tests := map[string]struct {
-		args         []string
-		input        string
-		expected     string
-		expectedCode int
+		args     []string
+		input    string
+		expected string
+		code     int
 	}{
-		"extract with match": {
-			args:         []string{"purl", "-extract", "@quick ([a-z]+) fox@animal: $1@", "-fail"},
-			input:        "The quick brown fox jumps over the lazy dog\nquick red fox",
-			expected:     "animal: brown\nanimal: red\n",
-			expectedCode: 0, // Success
+		"-C": {
+			args:     []string{"purl", "-C", "1", "-filter", "ERROR"},
+			input:    "a\nERROR 1\nb\nc\nd\nERROR 2\n",
+			expected: "a\nERROR 1\nb\n--\nd\nERROR 2\n",
+		},
+		"-A overrides -C": {
+			args:     []string{"purl", "-C", "1", "-A", "0", "-filter", "ERROR"},
+			input:    "a\nERROR 1\nb\n",
+			expected: "a\nERROR 1\n",
+		},
+		"excluded lines are not context": {
+			args:     []string{"purl", "-B", "1", "-filter", "ERROR", "-exclude", "debug"},
+			input:    "a\ndebug\nERROR 1\n",
+			expected: "a\nERROR 1\n",
+		},
+		"-context-excluded": {
+			args:     []string{"purl", "-B", "1", "-context-excluded", "-filter", "ERROR", "-exclude", "debug"},
+			input:    "a\ndebug\nERROR 1\n",
+			expected: "debug\nERROR 1\n",
+		},
+		"color only on matching lines": {
+			args:     []string{"purl", "-color", "-A", "1", "-filter", "ERROR"},
+			input:    "ERROR 1\nb ERR\n",
+			expected: "\x1b[1m\x1b[91mERROR\x1b[0m 1\nb ERR\n",
+		},
+		"context of the last filter": {
+			args:     []string{"purl", "-filter", "x", "-replace", "@x@y@", "-A", "1", "-filter", "1"},
+			input:    "x1\nx2\nz3\nx4\n",
+			expected: "y1\ny2\n",
+		},
+		"context with -chomp": {
+			args:     []string{"purl", "-chomp", "-B", "1", "-filter", "^ERROR$"},
+			input:    "a\r\nERROR\r\nb\r\nc\r\nERROR\r\n",
+			expected: "a\r\nERROR\r\n--\nc\r\nERROR\r\n",
+		},
+		"-fail ignores context lines": {
+			args:     []string{"purl", "-fail", "-C", "1", "-filter", "ERROR"},
+			input:    "a\nb\n",
+			expected: "",
+			code:     cli.ExitCodeNoMatch,
 		},
-		"extract with no match": {
-			args:         []string{"purl", "-extract", "@quick ([a-z]+) fox@animal: $1@", "-fail"},
-			input:        "The fast brown wolf jumps over the lazy dog",
-			expected:     "",
-			expectedCode: 1, // Fail due to no match
+		"without -filter": {
+			args: []string{"purl", "-C", "1", "-replace", "@a@b@"},
+			code: cli.ExitCodeFail,
 		},
-		"extract multiple groups with match": {
-			args:         []string{"purl", "-extract", "@(\\w+) (\\w+) (\\w+)@Match: $1, $2, $3@", "-fail"},
-			input:        "apple banana cherry\ngrape orange pineapple",
-			expected:     "Match: apple, banana, cherry\nMatch: grape, orange, pineapple\n",
-			expectedCode: 0, // Success
+		"negative": {
+			args: []string{"purl", "-A", "-1", "-filter", "a"},
+			code: cli.ExitCodeFail,
 		},
-		"extract multiple groups with no match": {
-			args:         []string{"purl", "-extract", "@(\\w+) (\\w+) (\\w+)@Match: $1, $2, $3@", "-fail"},
-			input:        "singleword only",
-			expected:     "",
-			expectedCode: 1, // Fail due to no match
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, strings.NewReader(tt.input), false, false)
+
+			if got := cl.Run(tt.args); got != tt.code {
+				t.Fatalf("Expected exit code %d, but got %d; error: %q", tt.code, got, errStream.String())
+			}
+
+			if outStream.String() != tt.expected {
+				t.Errorf("Output=%q, want %q", outStream.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestRun_contextFiles(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"a.txt": "x\nERR a\n",
+		"b.txt": "none\n",
+		"c.txt": "ERR c\ny\n",
+	})
+	a, b, c := filepath.Join(root, "a.txt"), filepath.Join(root, "b.txt"), filepath.Join(root, "c.txt")
+
+	outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+	cl := cli.NewCLI(outStream, errStream, os.Stdin, false, false)
+
+	if got := cl.Run([]string{"purl", "-A", "1", "-filter", "ERR", a, b, c}); got != 0 {
+		t.Fatalf("Expected exit code 0, but got %d; error: %q", got, errStream.String())
+	}
+
+	expected := a + ":ERR a\n--\n" + c + ":ERR c\n" + c + "-y\n"
+	if outStream.String() != expected {
+		t.Errorf("Output=%q, want %q", outStream.String(), expected)
+	}
+}
+
+func TestRun_prefixes(t *testing.T) {
+	tests := map[string]struct {
+		args     []string
+		input    string
+		expected string
+		code     int
+	}{
+		"-n": {
+			args:     []string{"purl", "-n", "-filter", "searchc", "testdata/testa.txt"},
+			expected: "1:searchc searchd\n",
+		},
+		"-b": {
+			args:     []string{"purl", "-b", "-filter", "not", "testdata/testa.txt"},
+			expected: "16:not not not\n",
+		},
+		"-H with a single file": {
+			args:     []string{"purl", "-H", "-n", "-b", "-filter", "not", "testdata/testa.txt"},
+			expected: "testdata/testa.txt:2:16:not not not\n",
+		},
+		"-H on stdin": {
+			args:     []string{"purl", "-H", "-filter", "b"},
+			input:    "a\nb\n",
+			expected: "(standard input):b\n",
+		},
+		"-no-filename wins over -H": {
+			args:     []string{"purl", "-H", "-no-filename", "-n", "-filter", "b"},
+			input:    "a\nb\n",
+			expected: "2:b\n",
+		},
+		"replace of multiple files has no file names": {
+			args:     []string{"purl", "-replace", "@not@NOT@", "testdata/testa.txt", "testdata/testa.txt"},
+			expected: "searchc searchd\nNOT NOT NOT\nsearchc searchd\nNOT NOT NOT\n",
+		},
+		"replace in multi-line mode numbers every line": {
+			args:     []string{"purl", "-n", "-replace", "@not@NOT@", "testdata/testa.txt"},
+			expected: "1:searchc searchd\n2:NOT NOT NOT\n",
+		},
+		"extract uses the line of the match": {
+			args:     []string{"purl", "-n", "-b", "-extract", "@quick ([a-z]+) fox@$1@", "testdata/test_extract.txt"},
+			expected: "1:4:brown\n2:46:red\n",
+		},
+		"context lines": {
+			args:     []string{"purl", "-n", "-A", "1", "-filter", "a"},
+			input:    "a\nb\nc\na\n",
+			expected: "1:a\n2-b\n--\n4:a\n",
+		},
+		"chomped empty line": {
+			args:     []string{"purl", "-n", "-chomp", "-filter", "^$"},
+			input:    "a\r\n\r\n",
+			expected: "2:\r\n",
+		},
+		"color": {
+			args:     []string{"purl", "-color", "-n", "-filter", "b"},
+			input:    "b\n",
+			expected: "\x1b[32m1\x1b[0m\x1b[36m:\x1b[0m\x1b[1m\x1b[91mb\x1b[0m\n",
+		},
+		"not with -overwrite": {
+			args: []string{"purl", "-n", "-overwrite", "-filter", "b", "testdata/testa.txt"},
+			code: cli.ExitCodeFail,
 		},
 	}
 
-	for name, test := range tests {
+	for name, tt := range tests {
 		t.Run(name, func(t *testing.T) {
 			t.Parallel()
-			outStream, errStream, inputStream := new(bytes.Buffer), new(bytes.Buffer), new(bytes.Buffer)
-			cl := cli.NewCLI(outStream, errStream, inputStream, false, false)
-			inputStream.WriteString(test.input)
+			outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, strings.NewReader(tt.input), false, false)
 
-			if got, expected := cl.Run(test.args), test.expectedCode; got != expected {
-				t.Fatalf("Expected exit code %d, but got %d; error: %q", expected, got, errStream.String())
+			if got := cl.Run(tt.args); got != tt.code {
+				t.Fatalf("Expected exit code %d, but got %d; error: %q", tt.code, got, errStream.String())
 			}
 
-			if outStream.String() != test.expected {
-				t.Errorf("Output=%q, want %q; error: %q", outStream.String(), test.expected, errStream.String())
+			if outStream.String() != tt.expected {
+				t.Errorf("Output=%q, want %q", outStream.String(), tt.expected)
 			}
 		})
 	}
 }
 
-func TestRun_MultiLineMode(t *testing.T) {
+func TestRun_onlyMatching(t *testing.T) {
 	tests := map[string]struct {
 		args     []string
 		input    string
 		expected string
+		code     int
 	}{
-		// -exclude
-		"exclude empty lines": {
-			args:     []string{"purl", "-exclude", "^\n$"},
-			input:    "line1\n\nline2\nline3\n\n",
-			expected: "line1\nline2\nline3\n",
+		"-o": {
+			args:     []string{"purl", "-o", "-filter", `\d+`},
+			input:    "a 1 b 22\nnone\n333\n",
+			expected: "1\n22\n333\n",
+		},
+		"multiple filters in order of position": {
+			args:     []string{"purl", "-only-matching", "-filter", `\d+`, "-filter", `[a-z]+`},
+			input:    "a 1 b 22\n",
+			expected: "a\n1\nb\n22\n",
+		},
+		"exclude acts on lines first": {
+			args:     []string{"purl", "-o", "-filter", `\d+`, "-exclude", "skip"},
+			input:    "1 skip\n2\n",
+			expected: "2\n",
+		},
+		"with prefixes": {
+			args:     []string{"purl", "-o", "-n", "-b", "-filter", `\d+`},
+			input:    "a 1 b 22\n333\n",
+			expected: "1:2:1\n1:6:22\n2:9:333\n",
+		},
+		"chomped lines keep their terminator": {
+			args:     []string{"purl", "-o", "-chomp", "-filter", `\w+$`},
+			input:    "a b\r\n",
+			expected: "b\r\n",
+		},
+		"color": {
+			args:     []string{"purl", "-o", "-color", "-filter", "b"},
+			input:    "abc\n",
+			expected: "\x1b[1m\x1b[91mb\x1b[0m\n",
+		},
+		"-count counts lines": {
+			args:     []string{"purl", "-o", "-count", "-filter", `\d`},
+			input:    "1 2\n3\n",
+			expected: "2\n",
+		},
+		"without -filter": {
+			args: []string{"purl", "-o", "-replace", "@a@b@"},
+			code: cli.ExitCodeFail,
 		},
-		"exclude lines with only spaces": {
-			args:     []string{"purl", "-exclude", "^\\s+$"},
-			input:    "line1\n   \nline2\nline3\n\t\n",
-			expected: "line1\nline2\nline3\n",
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, strings.NewReader(tt.input), false, false)
+
+			if got := cl.Run(tt.args); got != tt.code {
+				t.Fatalf("Expected exit code %d, but got %d; error: %q", tt.code, got, errStream.String())
+			}
+
+			if outStream.String() != tt.expected {
+				t.Errorf("Output=%q, want %q", outStream.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestRun_where(t *testing.T) {
+	input := "ERROR postgres timeout\nERROR postgres retry\nERROR mysql\nINFO postgres\nERROR mysql retry\n"
+
+	tests := map[string]struct {
+		args     []string
+		expected string
+		code     int
+	}{
+		"-all": {
+			args:     []string{"purl", "-all", "-filter", "ERROR", "-filter", "retry"},
+			expected: "ERROR postgres retry\nERROR mysql retry\n",
 		},
-		"exclude lines starting with #": {
-			args:     []string{"purl", "-exclude", "^#"},
-			input:    "#comment1\nline1\n#comment2\nline2\n",
-			expected: "line1\nline2\n",
+		"-all with -exclude": {
+			args:     []string{"purl", "-all", "-filter", "ERROR", "-filter", "postgres", "-exclude", "retry"},
+			expected: "ERROR postgres timeout\n",
 		},
-		// -filter
-		"filter lines starting with specific word": {
-			args:     []string{"purl", "-filter", "^START"},
-			input:    "START line1\nline2\nSTART line3\nline4\n",
-			expected: "START line1\nSTART line3\n",
+		"-where": {
+			args:     []string{"purl", "-p", "err=ERROR", "-p", "db=postgres", "-where", "err and (db or not retry)"},
+			expected: "ERROR postgres timeout\nERROR postgres retry\nERROR mysql\n",
 		},
-		"filter lines containing word": {
-			args:     []string{"purl", "-filter", "word"},
-			input:    "this is a word\nno match\nanother word here\n",
-			expected: "this is a word\nanother word here\n",
+		"-where with -filter": {
+			args:     []string{"purl", "-filter", "mysql", "-where", "not retry"},
+			expected: "ERROR mysql\n",
 		},
-		// -replace
-		"replace specific lines": {
-			args:     []string{"purl", "-line", "-replace", "@^line1@REPLACED@"},
-			input:    "line1\nline2\nline1 again\n",
-			expected: "REPLACED\nline2\nREPLACED again\n",
+		"-where with -i": {
+			args:     []string{"purl", "-i", "-p", "e=error", "-where", "e and MYSQL"},
+			expected: "ERROR mysql\nERROR mysql retry\n",
 		},
-		"replace word in multiple lines": {
-			args:     []string{"purl", "-replace", "@line@LINE@"},
-			input:    "line1\nline2\nnot this\nline3\n",
-			expected: "LINE1\nLINE2\nnot this\nLINE3\n",
+		"-where with -o highlights positive names": {
+			args:     []string{"purl", "-o", "-p", "db=post\\w+", "-where", "db and not retry"},
+			expected: "postgres\npostgres\n",
+		},
+		"-where with -count": {
+			args:     []string{"purl", "-count", "-where", "retry or INFO"},
+			expected: "3\n",
+		},
+		"invalid -where": {
+			args: []string{"purl", "-where", "a and"},
+			code: cli.ExitCodeFail,
+		},
+		"invalid -p": {
+			args: []string{"purl", "-p", "noequal", "-where", "a"},
+			code: cli.ExitCodeFail,
 		},
 	}
 
-	for name, test := range tests {
+	for name, tt := range tests {
 		t.Run(name, func(t *testing.T) {
 			t.Parallel()
-			outStream, errStream, inputStream := new(bytes.Buffer), new(bytes.Buffer), new(bytes.Buffer)
-			cl := cli.NewCLI(outStream, errStream, inputStream, false, false)
-			inputStream.WriteString(test.input)
+			outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, strings.NewReader(input), false, false)
 
-			if got, expected := cl.Run(test.args), 0; got != expected {
-				t.Fatalf("Expected exit code %d, but got %d; error: %q", expected, got, errStream.String())
+			if got := cl.Run(tt.args); got != tt.code {
+				t.Fatalf("Expected exit code %d, but got %d; error: %q", tt.code, got, errStream.String())
 			}
 
-			if outStream.String() != test.expected {
-				t.Errorf("Output=%q, want %q; error: %q", outStream.String(), test.expected, errStream.String())
+			if outStream.String() != tt.expected {
+				t.Errorf("Output=%q, want %q", outStream.String(), tt.expected)
 			}
 		})
 	}
 }
 
-func TestRun_ExtractWithLineMode(t *testing.T) {
+func TestRun_range(t *testing.T) {
+	input := "a\n# BEGIN\na\n# END\na\n# BEGIN\na\n"
+
 	tests := map[string]struct {
-		args         []string
-		input        string
-		expected     string
-		expectedCode int
+		args     []string
+		input    string
+		expected string
+		code     int
+		// multiLine skips the test in line mode
+		multiLine bool
 	}{
-		"extract with line mode": {
-			args:         []string{"purl", "-line", "-extract", "@quick ([a-z]+) fox@animal: $1@"},
-			input:        "The quick brown fox jumps over the lazy dog\nquick red fox\n",
-			expected:     "animal: brown\nanimal: red\n",
-			expectedCode: 0,
+		"replace passes other lines through": {
+			args:     []string{"purl", "-from", "BEGIN", "-to", "END", "-replace", "@(?m)^a$@Z@"},
+			expected: "a\n# BEGIN\nZ\n# END\na\n# BEGIN\nZ\n",
+		},
+		"filter drops other lines": {
+			args:     []string{"purl", "-after", "BEGIN", "-before", "END", "-filter", "."},
+			expected: "a\na\n",
+		},
+		"extract": {
+			args:     []string{"purl", "-from", "BEGIN", "-to", "END", "-extract", "@(?m)^(\\w+)$@$1@"},
+			expected: "a\na\n",
+		},
+		"multi-line patterns work inside a range": {
+			args:      []string{"purl", "-from", "BEGIN", "-to", "END", "-replace", "@BEGIN\\na@BEGIN a@"},
+			input:     "BEGIN\na\nEND\n",
+			expected:  "BEGIN a\nEND\n",
+			multiLine: true,
+		},
+		"-fail counts matches in range only": {
+			args:     []string{"purl", "-fail", "-from", "BEGIN", "-to", "END", "-replace", "@^b$@Z@"},
+			input:    "b\nBEGIN\nEND\n",
+			expected: "b\nBEGIN\nEND\n",
+			code:     cli.ExitCodeNoMatch,
+		},
+		"-from and -after": {
+			args: []string{"purl", "-from", "a", "-after", "b", "-filter", "."},
+			code: cli.ExitCodeFail,
 		},
 	}
 
-	for name, tc := range tests {
+	for name, tt := range tests {
 		t.Run(name, func(t *testing.T) {
 			t.Parallel()
-			outStream, errStream, inputStream := new(bytes.Buffer), new(bytes.Buffer), new(bytes.Buffer)
-			cl := cli.NewCLI(outStream, errStream, inputStream, false, false)
-			inputStream.WriteString(tc.input)
-
-			code := cl.Run(tc.args)
-			if code != tc.expectedCode {
-				t.Fatalf("Expected exit code %d, but got %d; error: %q", tc.expectedCode, code, errStream.String())
+			in := tt.input
+			if in == "" {
+				in = input
 			}
 
-			if outStream.String() != tc.expected {
-				t.Errorf("Output=%q, want %q", outStream.String(), tc.expected)
+			for _, mode := range []string{"-line", "-line=false"} {
+				if tt.multiLine && mode == "-line" {
+					continue
+				}
+
+				outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+				cl := cli.NewCLI(outStream, errStream, strings.NewReader(in), false, false)
+
+				args := append([]string{tt.args[0], mode}, tt.args[1:]...)
+				if got := cl.Run(args); got != tt.code {
+					t.Fatalf("%s: Expected exit code %d, but got %d; error: %q", mode, tt.code, got, errStream.String())
+				}
+
+				if outStream.String() != tt.expected {
+					t.Errorf("%s: Output=%q, want %q", mode, outStream.String(), tt.expected)
+				}
 			}
 		})
 	}
 }
+
+func TestRun_rangeOverwrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.txt")
+	if err := os.WriteFile(path, []byte("port=80\n[prod]\nport=80\n[dev]\nport=80\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+	cl := cli.NewCLI(outStream, errStream, os.Stdin, false, false)
+
+	if got := cl.Run([]string{"purl", "-overwrite", "-from", `^\[prod\]`, "-before", `^\[`, "-replace", "@port=80@port=443@", path}); got != 0 {
+		t.Fatalf("Expected exit code 0, but got %d; error: %q", got, errStream.String())
+	}
+
+	if expected := "port=80\n[prod]\nport=443\n[dev]\nport=80\n"; string(readFile(t, path)) != expected {
+		t.Errorf("File=%q, want %q", readFile(t, path), expected)
+	}
+}
+
+func TestRun_lines(t *testing.T) {
+	tests := map[string]struct {
+		args     []string
+		input    string
+		expected string
+		code     int
+	}{
+		"replace on the first line": {
+			args:     []string{"purl", "-lines", "1", "-replace", "@/python@/python3@"},
+			input:    "#!/usr/bin/python\nprint('python')\n",
+			expected: "#!/usr/bin/python3\nprint('python')\n",
+		},
+		"filter the last lines": {
+			args:     []string{"purl", "-lines", "-2:", "-filter", "."},
+			input:    "a\nb\nc\n",
+			expected: "b\nc\n",
+		},
+		"repeated -lines": {
+			args:     []string{"purl", "-n", "-lines", "1", "-lines", "3:", "-extract", "@(\\w)@$1$1@"},
+			input:    "a\nb\nc\n",
+			expected: "1:aa\n3:cc\n",
+		},
+		"with a range": {
+			args:     []string{"purl", "-lines", ":-2", "-from", "b", "-filter", "."},
+			input:    "a\nb\nc\nd\n",
+			expected: "b\nc\n",
+		},
+		"invalid": {
+			args: []string{"purl", "-lines", "3:1", "-filter", "."},
+			code: cli.ExitCodeFail,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			for _, mode := range []string{"-line", "-line=false"} {
+				outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+				cl := cli.NewCLI(outStream, errStream, strings.NewReader(tt.input), false, false)
+
+				args := append([]string{tt.args[0], mode}, tt.args[1:]...)
+				if got := cl.Run(args); got != tt.code {
+					t.Fatalf("%s: Expected exit code %d, but got %d; error: %q", mode, tt.code, got, errStream.String())
+				}
+
+				if outStream.String() != tt.expected {
+					t.Errorf("%s: Output=%q, want %q", mode, outStream.String(), tt.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestRun_linesOverwrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "main.go")
+	if err := os.WriteFile(path, []byte("// Copyright 2023\npackage main\n\n// Copyright 2023 is kept\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+	cl := cli.NewCLI(outStream, errStream, os.Stdin, false, false)
+
+	if got := cl.Run([]string{"purl", "-overwrite", "-lines", "1", "-replace", "@2023@2023-2026@", path}); got != 0 {
+		t.Fatalf("Expected exit code 0, but got %d; error: %q", got, errStream.String())
+	}
+
+	if expected := "// Copyright 2023-2026\npackage main\n\n// Copyright 2023 is kept\n"; string(readFile(t, path)) != expected {
+		t.Errorf("File=%q, want %q", readFile(t, path), expected)
+	}
+}
+
+func TestRun_guardedReplace(t *testing.T) {
+	input := "<img src=\"http://a\">\n<a href=\"http://b\">\n<img src=\"http://c\" data-keep>\n"
+
+	tests := map[string]struct {
+		args     []string
+		expected string
+		code     int
+	}{
+		"-on": {
+			args:     []string{"purl", "-on", "src=", "-replace", "@http://@https://@"},
+			expected: "<img src=\"https://a\">\n<a href=\"http://b\">\n<img src=\"https://c\" data-keep>\n",
+		},
+		"-on and -not-on": {
+			args:     []string{"purl", "-on", "src=", "-not-on", "keep", "-replace", "@http://@https://@"},
+			expected: "<img src=\"https://a\">\n<a href=\"http://b\">\n<img src=\"http://c\" data-keep>\n",
+		},
+		"-not-on": {
+			args:     []string{"purl", "-not-on", "img", "-replace", "@http://@https://@"},
+			expected: "<img src=\"http://a\">\n<a href=\"https://b\">\n<img src=\"http://c\" data-keep>\n",
+		},
+		"filters are not guarded": {
+			args:     []string{"purl", "-on", "src=", "-filter", "http", "-replace", "@http://@https://@"},
+			expected: "<img src=\"https://a\">\n<a href=\"http://b\">\n<img src=\"https://c\" data-keep>\n",
+		},
+		"-fail without a guarded match": {
+			args:     []string{"purl", "-fail", "-on", "nothing", "-replace", "@http://@https://@"},
+			expected: input,
+			code:     cli.ExitCodeNoMatch,
+		},
+		"without -replace": {
+			args: []string{"purl", "-on", "src=", "-filter", "a"},
+			code: cli.ExitCodeFail,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			for _, mode := range []string{"-line", "-line=false"} {
+				outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+				cl := cli.NewCLI(outStream, errStream, strings.NewReader(input), false, false)
+
+				args := append([]string{tt.args[0], mode}, tt.args[1:]...)
+				if got := cl.Run(args); got != tt.code {
+					t.Fatalf("%s: Expected exit code %d, but got %d; error: %q", mode, tt.code, got, errStream.String())
+				}
+
+				if outStream.String() != tt.expected {
+					t.Errorf("%s: Output=%q, want %q", mode, outStream.String(), tt.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestRun_guardedReplaceOverwrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.html")
+	if err := os.WriteFile(path, []byte("<img src=\"http://a\">\n<a href=\"http://b\">\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+	cl := cli.NewCLI(outStream, errStream, os.Stdin, false, false)
+
+	if got := cl.Run([]string{"purl", "-overwrite", "-fail", "-on", "src=", "-replace", "@http://@https://@", path}); got != 0 {
+		t.Fatalf("Expected exit code 0, but got %d; error: %q", got, errStream.String())
+	}
+
+	if expected := "<img src=\"https://a\">\n<a href=\"http://b\">\n"; string(readFile(t, path)) != expected {
+		t.Errorf("File=%q, want %q", readFile(t, path), expected)
+	}
+}
+
+func TestRun_fields(t *testing.T) {
+	input := "a,http://x,http://y\nb,c\nhttp://z,http://w,q\n"
+
+	tests := map[string]struct {
+		args     []string
+		input    string
+		expected string
+		code     int
+	}{
+		"replace": {
+			args:     []string{"purl", "-F", ",", "-field", "2", "-replace", "@http:@https:@"},
+			expected: "a,https://x,http://y\nb,c\nhttp://z,https://w,q\n",
+		},
+		"filter": {
+			args:     []string{"purl", "-F", ",", "-field", "3", "-filter", "^q$"},
+			expected: "http://z,http://w,q\n",
+		},
+		"exclude": {
+			args:     []string{"purl", "-F", ",", "-field", "1", "-exclude", "http"},
+			expected: "a,http://x,http://y\nb,c\n",
+		},
+		"extract fields": {
+			args:     []string{"purl", "-F", ",", "-extract", "@^(.),@$1=$f3@"},
+			expected: "a=http://y\nb=\n",
+		},
+		"regex separator": {
+			args:     []string{"purl", "-F", ",h", "-field", "2", "-replace", "@ttp@TTP@"},
+			expected: "a,hTTP://x,http://y\nb,c\nhttp://z,hTTP://w,q\n",
+		},
+		"tab": {
+			args:     []string{"purl", "-F", `\t`, "-field", "2", "-replace", "@.+@[$0]@"},
+			input:    "a b\tc d\te\n",
+			expected: "a b\t[c d]\te\n",
+		},
+		"blanks without -F": {
+			args:     []string{"purl", "-field", "2", "-replace", "@b@B@"},
+			input:    "  b  b b\n",
+			expected: "  b  B b\n",
+		},
+		"-fail without a match in the field": {
+			args: []string{"purl", "-fail", "-F", ",", "-field", "1", "-filter", "c"},
+			code: cli.ExitCodeNoMatch,
+		},
+		"negative field": {
+			args: []string{"purl", "-field", "-1", "-filter", "a"},
+			code: cli.ExitCodeFail,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			in := input
+			if tt.input != "" {
+				in = tt.input
+			}
+
+			for _, mode := range []string{"-line", "-line=false"} {
+				outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+				cl := cli.NewCLI(outStream, errStream, strings.NewReader(in), false, false)
+
+				args := append([]string{tt.args[0], mode}, tt.args[1:]...)
+				if got := cl.Run(args); got != tt.code {
+					t.Fatalf("%s: Expected exit code %d, but got %d; error: %q", mode, tt.code, got, errStream.String())
+				}
+
+				if outStream.String() != tt.expected {
+					t.Errorf("%s: Output=%q, want %q", mode, outStream.String(), tt.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestRun_csv(t *testing.T) {
+	input := "name,email,note\nAlice,alice@old.example,\"likes, commas\"\nBob,bob@new.example,\"multi\nline\"\n"
+
+	tests := map[string]struct {
+		args     []string
+		input    string
+		expected string
+		code     int
+	}{
+		"replace in a column": {
+			args:     []string{"purl", "-csv", "-header", "-column", "email", "-replace", "@old@new@"},
+			expected: "name,email,note\nAlice,alice@new.example,\"likes, commas\"\nBob,bob@new.example,\"multi\nline\"\n",
+		},
+		"filter a column": {
+			args:     []string{"purl", "-csv", "-header", "-column", "3", "-filter", "^line$"},
+			expected: "name,email,note\nBob,bob@new.example,\"multi\nline\"\n",
+		},
+		"extract": {
+			args:     []string{"purl", "-csv", "-header", "-column", "note", "-extract", "@, (.+)@$f1 $1@"},
+			expected: "Alice commas\n",
+		},
+		"tsv": {
+			args:     []string{"purl", "-tsv", "-column", "2", "-replace", "@ @,@"},
+			input:    "a\tb c\n",
+			expected: "a\tb,c\n",
+		},
+		"count": {
+			args:     []string{"purl", "-csv", "-header", "-count", "-filter", "example"},
+			expected: "2\n",
+		},
+		"-fail without a match": {
+			args: []string{"purl", "-csv", "-fail", "-column", "1", "-filter", "example"},
+			code: cli.ExitCodeNoMatch,
+		},
+		"invalid record": {
+			args:  []string{"purl", "-csv", "-filter", "a"},
+			input: "a,b\"c\n",
+			code:  cli.ExitCodeFail,
+		},
+		"column name without -header": {
+			args: []string{"purl", "-csv", "-column", "email", "-filter", "a"},
+			code: cli.ExitCodeFail,
+		},
+		"-column without -csv": {
+			args: []string{"purl", "-column", "1", "-filter", "a"},
+			code: cli.ExitCodeFail,
+		},
+		"-extract before another operation": {
+			args: []string{"purl", "-csv", "-extract", "@a@b@", "-filter", "b"},
+			code: cli.ExitCodeFail,
+		},
+		"-csv and -tsv": {
+			args: []string{"purl", "-csv", "-tsv", "-filter", "a"},
+			code: cli.ExitCodeFail,
+		},
+		"-n": {
+			args: []string{"purl", "-csv", "-n", "-filter", "a"},
+			code: cli.ExitCodeFail,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			in := input
+			if tt.input != "" {
+				in = tt.input
+			}
+
+			outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, strings.NewReader(in), false, false)
+
+			if got := cl.Run(tt.args); got != tt.code {
+				t.Fatalf("Expected exit code %d, but got %d; error: %q", tt.code, got, errStream.String())
+			}
+
+			if outStream.String() != tt.expected {
+				t.Errorf("Output=%q, want %q", outStream.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestRun_csvOverwrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.csv")
+	if err := os.WriteFile(path, []byte("name,note\r\nAlice,\"a\r\nb\"\r\nBob,plain\r\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+	cl := cli.NewCLI(outStream, errStream, os.Stdin, false, false)
+
+	if got := cl.Run([]string{"purl", "-overwrite", "-csv", "-header", "-column", "note", "-replace", "@plain@x, \"y\"@", path}); got != 0 {
+		t.Fatalf("Expected exit code 0, but got %d; error: %q", got, errStream.String())
+	}
+
+	if expected := "name,note\r\nAlice,\"a\r\nb\"\r\nBob,\"x, \"\"y\"\"\"\r\n"; string(readFile(t, path)) != expected {
+		t.Errorf("File=%q, want %q", readFile(t, path), expected)
+	}
+}
+
+func TestRun_diff(t *testing.T) {
+	input := "a\nb\nc\nd\ne\nf\ng\n"
+
+	tests := map[string]struct {
+		args     []string
+		expected string
+		code     int
+	}{
+		"changes": {
+			args:     []string{"purl", "-diff", "-replace", "@b@B@"},
+			expected: "--- (standard input)\n+++ (standard input)\n@@ -1,5 +1,5 @@\n a\n-b\n+B\n c\n d\n e\n",
+			code:     cli.ExitCodeChanged,
+		},
+		"-U and -filter": {
+			args:     []string{"purl", "-diff", "-U", "1", "-filter", "[a-e]"},
+			expected: "--- (standard input)\n+++ (standard input)\n@@ -5,3 +5 @@\n e\n-f\n-g\n",
+			code:     cli.ExitCodeChanged,
+		},
+		"no changes": {
+			args: []string{"purl", "-diff", "-replace", "@x@y@"},
+		},
+		"negative -U": {
+			args: []string{"purl", "-diff", "-U", "-1", "-replace", "@b@B@"},
+			code: cli.ExitCodeFail,
+		},
+		"with -count": {
+			args: []string{"purl", "-diff", "-count", "-replace", "@b@B@"},
+			code: cli.ExitCodeFail,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, strings.NewReader(input), false, false)
+
+			if got := cl.Run(tt.args); got != tt.code {
+				t.Fatalf("Expected exit code %d, but got %d; error: %q", tt.code, got, errStream.String())
+			}
+
+			if outStream.String() != tt.expected {
+				t.Errorf("Output=%q, want %q", outStream.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestRun_diffFiles(t *testing.T) {
+	dir := t.TempDir()
+	changed := filepath.Join(dir, "changed.txt")
+	unchanged := filepath.Join(dir, "unchanged.txt")
+	if err := os.WriteFile(changed, []byte("foo\nbar"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(unchanged, []byte("baz\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+	cl := cli.NewCLI(outStream, errStream, os.Stdin, false, false)
+
+	if got := cl.Run([]string{"purl", "-diff", "-replace", "@bar@qux@", changed, unchanged}); got != cli.ExitCodeChanged {
+		t.Fatalf("Expected exit code %d, but got %d; error: %q", cli.ExitCodeChanged, got, errStream.String())
+	}
+
+	expected := "--- " + changed + "\n+++ " + changed + "\n@@ -1,2 +1,2 @@\n foo\n-bar\n\\ No newline at end of file\n+qux\n\\ No newline at end of file\n"
+	if outStream.String() != expected {
+		t.Errorf("Output=%q, want %q", outStream.String(), expected)
+	}
+
+	if string(readFile(t, changed)) != "foo\nbar" {
+		t.Errorf("file was modified: %q", readFile(t, changed))
+	}
+}
+
+func TestRun_patch(t *testing.T) {
+	repo := t.TempDir()
+	if err := os.Mkdir(filepath.Join(repo, ".git"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(repo, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]struct {
+		content string
+		perm    os.FileMode
+	}{
+		"sub/a.txt":   {"foo\nbar", 0o644},
+		"sub/run.sh":  {"#!/bin/sh\necho foo\n", 0o755},
+		"sub/b c.txt": {"foo\n", 0o644},
+		"sub/n.txt":   {"nothing\n", 0o644},
+	}
+	for name, f := range files {
+		if err := os.WriteFile(filepath.Join(repo, name), []byte(f.content), f.perm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	patch := filepath.Join(t.TempDir(), "out.diff")
+	outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+	cl := cli.NewCLI(outStream, errStream, os.Stdin, false, false)
+
+	args := []string{"purl", "-patch", patch, "-U", "1", "-replace", "@foo@baz@"}
+	for _, name := range []string{"sub/a.txt", "sub/run.sh", "sub/b c.txt", "sub/n.txt"} {
+		args = append(args, filepath.Join(repo, name))
+	}
+	if got := cl.Run(args); got != 0 {
+		t.Fatalf("Expected exit code 0, but got %d; error: %q", got, errStream.String())
+	}
+	if outStream.Len() > 0 {
+		t.Errorf("Output=%q, want nothing", outStream.String())
+	}
+
+	expected := `diff --git a/sub/a.txt b/sub/a.txt
+index a907ec3f431eeb6b1c75799a7e4ba73ca6dc627a..97c93d0346536e60a942b9cd62b30dbcd9704449 100644
+--- a/sub/a.txt
++++ b/sub/a.txt
+@@ -1,2 +1,2 @@
+-foo
++baz
+ bar
+\ No newline at end of file
+diff --git a/sub/run.sh b/sub/run.sh
+index 8244374b0a406132d3a11d51a23c7a3e500a51ac..e8db4a68ef7bac0115ef5b88d561e4b9eca05e22 100755
+--- a/sub/run.sh
++++ b/sub/run.sh
+@@ -1,2 +1,2 @@
+ #!/bin/sh
+-echo foo
++echo baz
+diff --git a/sub/b c.txt b/sub/b c.txt
+index 257cc5642cb1a054f08cc83f2d943e56fd3ebe99..76018072e09c5d31c8c6e3113b8aa0fe625195ca 100644
+--- a/sub/b c.txt	
++++ b/sub/b c.txt	
+@@ -1 +1 @@
+-foo
++baz
+`
+	if got := string(readFile(t, patch)); got != expected {
+		t.Errorf("Patch=%q, want %q", got, expected)
+	}
+
+	for name, f := range files {
+		if got := string(readFile(t, filepath.Join(repo, name))); got != f.content {
+			t.Errorf("%s was modified: %q", name, got)
+		}
+	}
+}
+
+func TestRun_patchErrors(t *testing.T) {
+	tests := map[string][]string{
+		"stdin":      {"purl", "-patch", "out.diff", "-replace", "@a@b@"},
+		"with -diff": {"purl", "-patch", "out.diff", "-diff", "-replace", "@a@b@", "cli.go"},
+	}
+
+	for name, args := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, strings.NewReader("a\n"), false, false)
+
+			if got := cl.Run(args); got != cli.ExitCodeFail {
+				t.Fatalf("Expected exit code %d, but got %d; error: %q", cli.ExitCodeFail, got, errStream.String())
+			}
+		})
+	}
+}
+
+func TestRun_jsonl(t *testing.T) {
+	input := `{"level":"info","request":{"path":"/users?token=abc"},"msg":"token=abc"}
+not json
+{"level":"error","status":500,"request":{"path":"/health"}}
+`
+
+	tests := map[string]struct {
+		args     []string
+		expected string
+		stderr   string
+		code     int
+	}{
+		"replace a key": {
+			args:     []string{"purl", "-jsonl", "-key", ".request.path", "-replace", "@token=\\w+@token=***@"},
+			expected: `{"level":"info","request":{"path":"/users?token=***"},"msg":"token=abc"}` + "\nnot json\n" + `{"level":"error","status":500,"request":{"path":"/health"}}` + "\n",
+		},
+		"filter with line numbers": {
+			args:     []string{"purl", "-jsonl", "-n", "-key", ".level", "-filter", "^error$"},
+			expected: "3:" + `{"level":"error","status":500,"request":{"path":"/health"}}` + "\n",
+		},
+		"where": {
+			args:     []string{"purl", "-jsonl", "-key", ".level", "-p", "info=info", "-where", "not info"},
+			expected: `{"level":"error","status":500,"request":{"path":"/health"}}` + "\n",
+		},
+		"filter and report lines that are not JSON": {
+			args:     []string{"purl", "-jsonl", "-invalid-json", "report", "-key", ".level", "-filter", "error"},
+			expected: `{"level":"error","status":500,"request":{"path":"/health"}}` + "\n",
+			stderr:   "Not JSON: (standard input):2\n",
+		},
+		"exclude keeps lines that are not JSON": {
+			args:     []string{"purl", "-jsonl", "-key", ".level", "-exclude", "info"},
+			expected: "not json\n" + `{"level":"error","status":500,"request":{"path":"/health"}}` + "\n",
+		},
+		"report lines that are not JSON": {
+			args:     []string{"purl", "-jsonl", "-invalid-json", "report", "-key", ".status", "-count", "-filter", "500"},
+			expected: "1\n",
+			stderr:   "Not JSON: (standard input):2\n",
+		},
+		"extract": {
+			args:     []string{"purl", "-jsonl", "-key", ".request.path", "-key", ".msg", "-extract", "@token=(\\w+)@$1@"},
+			expected: "abc\nabc\n",
+		},
+		"extract and report lines that are not JSON": {
+			args:     []string{"purl", "-jsonl", "-invalid-json", "report", "-key", ".request.path", "-extract", "@token=(\\w+)@$1@"},
+			expected: "abc\n",
+			stderr:   "Not JSON: (standard input):2\n",
+		},
+		"-key without -jsonl": {
+			args: []string{"purl", "-key", ".a", "-filter", "a"},
+			code: cli.ExitCodeFail,
+		},
+		"-jsonl without -key": {
+			args: []string{"purl", "-jsonl", "-filter", "a"},
+			code: cli.ExitCodeFail,
+		},
+		"invalid key": {
+			args: []string{"purl", "-jsonl", "-key", "a", "-filter", "a"},
+			code: cli.ExitCodeFail,
+		},
+		"invalid -invalid-json": {
+			args: []string{"purl", "-jsonl", "-key", ".a", "-invalid-json", "drop", "-filter", "a"},
+			code: cli.ExitCodeFail,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, strings.NewReader(input), false, false)
+
+			if got := cl.Run(tt.args); got != tt.code {
+				t.Fatalf("Expected exit code %d, but got %d; error: %q", tt.code, got, errStream.String())
+			}
+
+			if outStream.String() != tt.expected {
+				t.Errorf("Output=%q, want %q", outStream.String(), tt.expected)
+			}
+			if tt.code == 0 && errStream.String() != tt.stderr {
+				t.Errorf("Error=%q, want %q", errStream.String(), tt.stderr)
+			}
+		})
+	}
+}
+
+func TestRun_json(t *testing.T) {
+	input := "GET /a 200\nPOST /b 500\nnothing\n"
+
+	tests := map[string]struct {
+		args     []string
+		expected string
+		code     int
+	}{
+		"extract": {
+			args: []string{"purl", "-json", "-extract", "@(?P<method>[A-Z]+) (/\\w+)(x)?@$1@"},
+			expected: `{"type":"match","path":"(standard input)","line":1,"offset":0,"text":"GET /a 200","match":"GET /a","groups":["GET","/a",null],"named":{"method":"GET"}}
+{"type":"match","path":"(standard input)","line":2,"offset":11,"text":"POST /b 500","match":"POST /b","groups":["POST","/b",null],"named":{"method":"POST"}}
+{"type":"summary","files":[{"path":"(standard input)","matches":2}],"matches":2}
+`,
+		},
+		"filter": {
+			args: []string{"purl", "-json", "-filter", "5.0", "-filter", "/b"},
+			expected: `{"type":"match","path":"(standard input)","line":2,"offset":16,"text":"POST /b 500","match":"/b","groups":[],"named":{}}
+{"type":"match","path":"(standard input)","line":2,"offset":19,"text":"POST /b 500","match":"500","groups":[],"named":{}}
+{"type":"summary","files":[{"path":"(standard input)","matches":2}],"matches":2}
+`,
+		},
+		"-replace after the search": {
+			args: []string{"purl", "-json", "-filter", "500", "-replace", "@POST@PUT@"},
+			expected: `{"type":"match","path":"(standard input)","line":2,"offset":18,"text":"PUT /b 500","match":"500","groups":[],"named":{}}
+{"type":"summary","files":[{"path":"(standard input)","matches":1}],"matches":1}
+`,
+		},
+		"-fail without a match": {
+			args: []string{"purl", "-json", "-fail", "-filter", "DELETE"},
+			expected: `{"type":"summary","files":[{"path":"(standard input)","matches":0}],"matches":0}
+`,
+			code: cli.ExitCodeNoMatch,
+		},
+		"without a search": {
+			args: []string{"purl", "-json", "-replace", "@a@b@"},
+			code: cli.ExitCodeFail,
+		},
+		"with -n": {
+			args: []string{"purl", "-json", "-n", "-filter", "a"},
+			code: cli.ExitCodeFail,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, strings.NewReader(input), false, false)
+
+			if got := cl.Run(tt.args); got != tt.code {
+				t.Fatalf("Expected exit code %d, but got %d; error: %q", tt.code, got, errStream.String())
+			}
+
+			if outStream.String() != tt.expected {
+				t.Errorf("Output=%q, want %q", outStream.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestRun_jsonEncoding(t *testing.T) {
+	tests := map[string]string{
+		"utf-8 bom":    "\xef\xbb\xbfx1\n",
+		"utf-16le bom": "\xff\xfex\x001\x00\n\x00",
+	}
+
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, strings.NewReader(input), false, false)
+
+			if got := cl.Run([]string{"purl", "-json", "-filter", "x"}); got != 0 {
+				t.Fatalf("Expected exit code 0, but got %d; error: %q", got, errStream.String())
+			}
+
+			expected := `{"type":"match","path":"(standard input)","line":1,"offset":0,"text":"x1","match":"x","groups":[],"named":{}}
+{"type":"summary","files":[{"path":"(standard input)","matches":1}],"matches":1}
+`
+			if outStream.String() != expected {
+				t.Errorf("Output=%q, want %q", outStream.String(), expected)
+			}
+		})
+	}
+}
+
+func TestRun_jsonFiles(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")
+	if err := os.WriteFile(a, []byte("x1\nx2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(b, []byte("y\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+	cl := cli.NewCLI(outStream, errStream, os.Stdin, false, false)
+
+	if got := cl.Run([]string{"purl", "-json", "-filter", "x", a, b}); got != 0 {
+		t.Fatalf("Expected exit code 0, but got %d; error: %q", got, errStream.String())
+	}
+
+	lines := strings.Split(strings.TrimSuffix(outStream.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Output=%q, want 3 lines", outStream.String())
+	}
+
+	var summary struct {
+		Files []struct {
+			Path    string
+			Matches int
+		}
+		Matches int
+	}
+	if err := json.Unmarshal([]byte(lines[2]), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Matches != 2 || len(summary.Files) != 2 || summary.Files[0].Path != a || summary.Files[0].Matches != 2 || summary.Files[1].Matches != 0 {
+		t.Errorf("Summary=%+v", summary)
+	}
+}
+
+func TestRun_report(t *testing.T) {
+	input := "const a = 1 // TODO: fix\nconsole.log(\"é\") // TODO\n"
+
+	tests := map[string]struct {
+		args     []string
+		expected string
+		code     int
+	}{
+		"github": {
+			args: []string{"purl", "-report", "github", "-filter", "TODO", "-message", "No TODO, 100%", "-severity", "warning", "-replace", "@console\\.log@logger.debug@"},
+			expected: "::warning file=(standard input),line=1,col=16,endColumn=20,title=purl::No TODO, 100%25\n" +
+				"::warning file=(standard input),line=2,col=21,endColumn=25,title=purl::No TODO, 100%25\n" +
+				"::error file=(standard input),line=2,col=1,endColumn=12,title=purl::-replace @console\\.log@logger.debug@\n",
+		},
+		"quickfix with -exclude": {
+			args:     []string{"purl", "-report", "quickfix", "-filter", "TODO", "-severity", "note", "-exclude", "const"},
+			expected: "(standard input):2:21: note: -filter TODO\n",
+		},
+		"only -replace": {
+			args:     []string{"purl", "-report", "quickfix", "-replace", "@console@logger@"},
+			expected: "(standard input):2:1: error: -replace @console@logger@\n",
+		},
+		"only -extract": {
+			args:     []string{"purl", "-report", "github", "-extract", "@const (\\w+)@$1@"},
+			expected: "::error file=(standard input),line=1,col=1,endColumn=8,title=purl::-extract @const (\\w+)@$1@\n",
+		},
+		"only -replace with -fail": {
+			args: []string{"purl", "-report", "quickfix", "-fail", "-replace", "@FIXME@x@"},
+			code: cli.ExitCodeNoMatch,
+		},
+		"-fail without a match": {
+			args: []string{"purl", "-report", "quickfix", "-fail", "-filter", "FIXME"},
+			code: cli.ExitCodeNoMatch,
+		},
+		"junit": {
+			args: []string{"purl", "-report", "junit", "-filter", "TODO", "-extract", "@FIXME@@"},
+			expected: `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="purl" tests="2" failures="1">
+    <testcase name="-filter TODO" classname="(standard input)">
+      <failure message="2 matches" type="error">(standard input):1:16: TODO&#xA;(standard input):2:21: TODO&#xA;</failure>
+    </testcase>
+    <testcase name="-extract @FIXME@@" classname="(standard input)"></testcase>
+  </testsuite>
+</testsuites>
+`,
+		},
+		"invalid format": {
+			args: []string{"purl", "-report", "html", "-filter", "TODO"},
+			code: cli.ExitCodeFail,
+		},
+		"-message before an operation": {
+			args: []string{"purl", "-report", "github", "-message", "x", "-filter", "TODO"},
+			code: cli.ExitCodeParseFlagError,
+		},
+		"invalid severity": {
+			args: []string{"purl", "-report", "github", "-filter", "TODO", "-severity", "fatal"},
+			code: cli.ExitCodeParseFlagError,
+		},
+		"only -exclude": {
+			args: []string{"purl", "-report", "github", "-exclude", "TODO"},
+			code: cli.ExitCodeFail,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, strings.NewReader(input), false, false)
+
+			if got := cl.Run(tt.args); got != tt.code {
+				t.Fatalf("Expected exit code %d, but got %d; error: %q", tt.code, got, errStream.String())
+			}
+
+			if outStream.String() != tt.expected {
+				t.Errorf("Output=%q, want %q", outStream.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestRun_reportEncoding(t *testing.T) {
+	tests := map[string]string{
+		"utf-8 bom":    "\xef\xbb\xbfx1\n",
+		"utf-16le bom": "\xff\xfex\x001\x00\n\x00",
+	}
+
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, strings.NewReader(input), false, false)
+
+			if got := cl.Run([]string{"purl", "-report", "github", "-filter", "x"}); got != 0 {
+				t.Fatalf("Expected exit code 0, but got %d; error: %q", got, errStream.String())
+			}
+
+			expected := "::error file=(standard input),line=1,col=1,endColumn=2,title=purl::-filter x\n"
+			if outStream.String() != expected {
+				t.Errorf("Output=%q, want %q", outStream.String(), expected)
+			}
+		})
+	}
+}
+
+func TestRun_reportSARIF(t *testing.T) {
+	outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+	cl := cli.NewCLI(outStream, errStream, strings.NewReader("ok\nx := \"é\" // TODO\n"), false, false)
+
+	if got := cl.Run([]string{"purl", "-report", "sarif", "-filter", "TODO", "-message", "No TODO", "-severity", "warning"}); got != 0 {
+		t.Fatalf("Expected exit code 0, but got %d; error: %q", got, errStream.String())
+	}
+
+	var log struct {
+		Version string
+		Runs    []struct {
+			Tool struct {
+				Driver struct {
+					Name  string
+					Rules []struct {
+						ID string
+					}
+				}
+			}
+			Results []struct {
+				RuleID    string
+				Level     string
+				Message   struct{ Text string }
+				Locations []struct {
+					PhysicalLocation struct {
+						ArtifactLocation struct{ URI string }
+						Region           struct{ StartLine, StartColumn, EndColumn int }
+					}
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(outStream.Bytes(), &log); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, outStream.String())
+	}
+
+	if log.Version != "2.1.0" || len(log.Runs) != 1 || log.Runs[0].Tool.Driver.Name != "purl" || len(log.Runs[0].Tool.Driver.Rules) != 1 {
+		t.Fatalf("unexpected log: %+v", log)
+	}
+
+	results := log.Runs[0].Results
+	if len(results) != 1 {
+		t.Fatalf("Results=%+v, want 1 result", results)
+	}
+	r := results[0]
+	region := r.Locations[0].PhysicalLocation.Region
+	if r.RuleID != log.Runs[0].Tool.Driver.Rules[0].ID || r.Level != "warning" || r.Message.Text != "No TODO" ||
+		region.StartLine != 2 || region.StartColumn != 13 || region.EndColumn != 17 {
+		t.Errorf("Result=%+v", r)
+	}
+}
+
+func TestRun_summary(t *testing.T) {
+	tests := map[string]struct {
+		args     []string
+		input    string
+		expected string
+		code     int
+	}{
+		"-count lines of -filter": {
+			args:     []string{"purl", "-count", "-filter", "search", "testdata/test.txt", "testdata/testa.txt"},
+			expected: "testdata/test.txt:1\ntestdata/testa.txt:1\n",
+		},
+		"-count replacements": {
+			args:     []string{"purl", "-count", "-i", "-replace", "@search@x@", "testdata/test.txt"},
+			expected: "4\n",
+		},
+		"-count replacements of multiple files": {
+			args:     []string{"purl", "-count", "-replace", "@not@x@", "testdata/test.txt", "testdata/testa.txt"},
+			expected: "testdata/test.txt:0\ntestdata/testa.txt:3\n",
+		},
+		"-count extracted matches": {
+			args:     []string{"purl", "-count", "-extract", "@quick ([a-z]+) fox@$1@", "testdata/test_extract.txt"},
+			expected: "2\n",
+		},
+		"-count kept lines with only -exclude": {
+			args:     []string{"purl", "-count", "-exclude", "b"},
+			input:    "a\nb\nc\n",
+			expected: "2\n",
+		},
+		"-count ignores context": {
+			args:     []string{"purl", "-count", "-C", "1", "-filter", "b"},
+			input:    "a\nb\nc\n",
+			expected: "1\n",
+		},
+		"-l": {
+			args:     []string{"purl", "-l", "-filter", "not", "testdata/test.txt", "testdata/testa.txt"},
+			expected: "testdata/testa.txt\n",
+		},
+		"-L": {
+			args:     []string{"purl", "-files-without-match", "-filter", "not", "testdata/test.txt", "testdata/testa.txt"},
+			expected: "testdata/test.txt\n",
+		},
+		"-l with -replace": {
+			args:     []string{"purl", "-l", "-replace", "@Search@x@", "testdata/test.txt", "testdata/testa.txt"},
+			expected: "testdata/test.txt\n",
+		},
+		"-l -0": {
+			args:     []string{"purl", "-l", "-0", "-filter", "search", "testdata/test.txt", "testdata/testa.txt"},
+			expected: "testdata/test.txt\x00testdata/testa.txt\x00",
+		},
+		"-l on stdin": {
+			args:     []string{"purl", "-l", "-filter", "b"},
+			input:    "a\nb\n",
+			expected: "(standard input)\n",
+		},
+		"-fail with -count": {
+			args:     []string{"purl", "-fail", "-count", "-filter", "z"},
+			input:    "a\nb\n",
+			expected: "0\n",
+			code:     cli.ExitCodeNoMatch,
+		},
+		"-l and -L together": {
+			args: []string{"purl", "-l", "-L", "-filter", "a", "testdata/test.txt"},
+			code: cli.ExitCodeFail,
+		},
+		"-count with -overwrite": {
+			args: []string{"purl", "-count", "-overwrite", "-replace", "@a@b@", "testdata/test.txt"},
+			code: cli.ExitCodeFail,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, strings.NewReader(tt.input), false, false)
+
+			if got := cl.Run(tt.args); got != tt.code {
+				t.Fatalf("Expected exit code %d, but got %d; error: %q", tt.code, got, errStream.String())
+			}
+
+			if outStream.String() != tt.expected {
+				t.Errorf("Output=%q, want %q", outStream.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestRun_ExtractWithFail(t *testing.T) {
+	tests := map[string]struct {
+		args         []string
+		input        string
+		expected     string
+		expectedCode int
+	}{
+		"extract with match": {
+			args:         []string{"purl", "-extract", "@quick ([a-z]+) fox@animal: $1@", "-fail"},
+			input:        "The quick brown fox jumps over the lazy dog\nquick red fox",
+			expected:     "animal: brown\nanimal: red\n",
+			expectedCode: 0, // Success
+		},
+		"extract with no match": {
+			args:         []string{"purl", "-extract", "@quick ([a-z]+) fox@animal: $1@", "-fail"},
+			input:        "The fast brown wolf jumps over the lazy dog",
+			expected:     "",
+			expectedCode: 1, // Fail due to no match
+		},
+		"extract multiple groups with match": {
+			args:         []string{"purl", "-extract", "@(\\w+) (\\w+) (\\w+)@Match: $1, $2, $3@", "-fail"},
+			input:        "apple banana cherry\ngrape orange pineapple",
+			expected:     "Match: apple, banana, cherry\nMatch: grape, orange, pineapple\n",
+			expectedCode: 0, // Success
+		},
+		"extract multiple groups with no match": {
+			args:         []string{"purl", "-extract", "@(\\w+) (\\w+) (\\w+)@Match: $1, $2, $3@", "-fail"},
+			input:        "singleword only",
+			expected:     "",
+			expectedCode: 1, // Fail due to no match
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			outStream, errStream, inputStream := new(bytes.Buffer), new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, inputStream, false, false)
+			inputStream.WriteString(test.input)
+
+			if got, expected := cl.Run(test.args), test.expectedCode; got != expected {
+				t.Fatalf("Expected exit code %d, but got %d; error: %q", expected, got, errStream.String())
+			}
+
+			if outStream.String() != test.expected {
+				t.Errorf("Output=%q, want %q; error: %q", outStream.String(), test.expected, errStream.String())
+			}
+		})
+	}
+}
+
+func TestRun_MultiLineMode(t *testing.T) {
+	tests := map[string]struct {
+		args     []string
+		input    string
+		expected string
+	}{
+		// -exclude
+		"exclude empty lines": {
+			args:     []string{"purl", "-exclude", "^\n$"},
+			input:    "line1\n\nline2\nline3\n\n",
+			expected: "line1\nline2\nline3\n",
+		},
+		"exclude lines with only spaces": {
+			args:     []string{"purl", "-exclude", "^\\s+$"},
+			input:    "line1\n   \nline2\nline3\n\t\n",
+			expected: "line1\nline2\nline3\n",
+		},
+		"exclude lines starting with #": {
+			args:     []string{"purl", "-exclude", "^#"},
+			input:    "#comment1\nline1\n#comment2\nline2\n",
+			expected: "line1\nline2\n",
+		},
+		// -filter
+		"filter lines starting with specific word": {
+			args:     []string{"purl", "-filter", "^START"},
+			input:    "START line1\nline2\nSTART line3\nline4\n",
+			expected: "START line1\nSTART line3\n",
+		},
+		"filter lines containing word": {
+			args:     []string{"purl", "-filter", "word"},
+			input:    "this is a word\nno match\nanother word here\n",
+			expected: "this is a word\nanother word here\n",
+		},
+		// -replace
+		"replace specific lines": {
+			args:     []string{"purl", "-line", "-replace", "@^line1@REPLACED@"},
+			input:    "line1\nline2\nline1 again\n",
+			expected: "REPLACED\nline2\nREPLACED again\n",
+		},
+		"replace word in multiple lines": {
+			args:     []string{"purl", "-replace", "@line@LINE@"},
+			input:    "line1\nline2\nnot this\nline3\n",
+			expected: "LINE1\nLINE2\nnot this\nLINE3\n",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			outStream, errStream, inputStream := new(bytes.Buffer), new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, inputStream, false, false)
+			inputStream.WriteString(test.input)
+
+			if got, expected := cl.Run(test.args), 0; got != expected {
+				t.Fatalf("Expected exit code %d, but got %d; error: %q", expected, got, errStream.String())
+			}
+
+			if outStream.String() != test.expected {
+				t.Errorf("Output=%q, want %q; error: %q", outStream.String(), test.expected, errStream.String())
+			}
+		})
+	}
+}
+
+func TestRun_ExtractWithLineMode(t *testing.T) {
+	tests := map[string]struct {
+		args         []string
+		input        string
+		expected     string
+		expectedCode int
+	}{
+		"extract with line mode": {
+			args:         []string{"purl", "-line", "-extract", "@quick ([a-z]+) fox@animal: $1@"},
+			input:        "The quick brown fox jumps over the lazy dog\nquick red fox\n",
+			expected:     "animal: brown\nanimal: red\n",
+			expectedCode: 0,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			outStream, errStream, inputStream := new(bytes.Buffer), new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, inputStream, false, false)
+			inputStream.WriteString(tc.input)
+
+			code := cl.Run(tc.args)
+			if code != tc.expectedCode {
+				t.Fatalf("Expected exit code %d, but got %d; error: %q", tc.expectedCode, code, errStream.String())
+			}
+
+			if outStream.String() != tc.expected {
+				t.Errorf("Output=%q, want %q", outStream.String(), tc.expected)
+			}
+		})
+	}
+}
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+}
+
+func TestRun_recursive(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		".git/config":     "search git\n",
+		".gitignore":      "*.log\nbuild/\n!keep.log\n",
+		".hidden.txt":     "search hidden\n",
+		"a.txt":           "search a\n",
+		"b.log":           "search b\n",
+		"build/c.txt":     "search c\n",
+		"keep.log":        "search keep\n",
+		"sub/.purlignore": "skip.txt\n",
+		"sub/d.txt":       "search d\n",
+		"sub/e.log":       "search e\n",
+		"sub/skip.txt":    "search skip\n",
+	})
+
+	tests := map[string]struct {
+		args     []string
+		expected string
+	}{
+		"honor ignore files": {
+			args:     []string{"purl", "-no-filename", "-r", "-filter", "search", root},
+			expected: "search a\nsearch keep\nsearch d\n",
+		},
+		"long option": {
+			args:     []string{"purl", "-no-filename", "-recursive", "-filter", "search", root},
+			expected: "search a\nsearch keep\nsearch d\n",
+		},
+		"include hidden files": {
+			args:     []string{"purl", "-no-filename", "-r", "-hidden", "-filter", "search", root},
+			expected: "search hidden\nsearch a\nsearch keep\nsearch d\n",
+		},
+		"no ignore": {
+			args:     []string{"purl", "-no-filename", "-r", "-no-ignore", "-filter", "search", root},
+			expected: "search a\nsearch b\nsearch c\nsearch keep\nsearch d\nsearch e\nsearch skip\n",
+		},
+		"sub directory honors parent ignore files": {
+			args:     []string{"purl", "-no-filename", "-r", "-filter", "search", filepath.Join(root, "sub")},
+			expected: "search d\n",
+		},
+		"explicit file is not ignored": {
+			args:     []string{"purl", "-no-filename", "-r", "-filter", "search", filepath.Join(root, "b.log")},
+			expected: "search b\n",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, os.Stdin, false, false)
+
+			if got := cl.Run(tt.args); got != 0 {
+				t.Fatalf("Expected exit code 0, but got %d; error: %q", got, errStream.String())
+			}
+
+			if outStream.String() != tt.expected {
+				t.Errorf("Output=%q, want %q; error: %q", outStream.String(), tt.expected, errStream.String())
+			}
+		})
+	}
+}
+
+func TestRun_recursiveOverwrite(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		".gitignore":  "*.log\n",
+		"a.txt":       "search a\n",
+		"b.log":       "search b\n",
+		"sub/c.txt":   "search c\n",
+		".hidden.txt": "search hidden\n",
+	})
+
+	outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+	cl := cli.NewCLI(outStream, errStream, os.Stdin, false, false)
+
+	if got := cl.Run([]string{"purl", "-r", "-overwrite", "-replace", "@search@replacement@", root}); got != 0 {
+		t.Fatalf("Expected exit code 0, but got %d; error: %q", got, errStream.String())
+	}
+
+	expected := map[string]string{
+		"a.txt":       "replacement a\n",
+		"b.log":       "search b\n",
+		"sub/c.txt":   "replacement c\n",
+		".hidden.txt": "search hidden\n",
+	}
+	for name, want := range expected {
+		b, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", name, err)
+		}
+		if string(b) != want {
+			t.Errorf("%s=%q, want %q", name, string(b), want)
+		}
+	}
+}
+
+func TestRun_directoryWithoutRecursive(t *testing.T) {
+	outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+	cl := cli.NewCLI(outStream, errStream, os.Stdin, false, false)
+
+	if got := cl.Run([]string{"purl", "-filter", "search", "testdata"}); got != cli.ExitCodeFail {
+		t.Fatalf("Expected exit code %d, but got %d; error: %q", cli.ExitCodeFail, got, errStream.String())
+	}
+
+	if !strings.Contains(errStream.String(), "use -r") {
+		t.Errorf("Error=%q", errStream.String())
+	}
+}
+
+func TestMatchIgnorePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		isDir   bool
+		want    bool
+	}{
+		{pattern: "*.log", path: "a.log", want: true},
+		{pattern: "*.log", path: "dir/a.log", want: true},
+		{pattern: "*.log", path: "a.txt", want: false},
+		{pattern: "/a.log", path: "dir/a.log", want: false},
+		{pattern: "/a.log", path: "a.log", want: true},
+		{pattern: "dir/*.txt", path: "dir/a.txt", want: true},
+		{pattern: "dir/*.txt", path: "dir/sub/a.txt", want: false},
+		{pattern: "dir/**/a.txt", path: "dir/x/y/a.txt", want: true},
+		{pattern: "dir/**/a.txt", path: "dir/a.txt", want: true},
+		{pattern: "**/vendor", path: "x/vendor", isDir: true, want: true},
+		{pattern: "build/", path: "build", isDir: true, want: true},
+		{pattern: "build/", path: "build", isDir: false, want: false},
+		{pattern: "a?c", path: "abc", want: true},
+		{pattern: "[ab].txt", path: "b.txt", want: true},
+		{pattern: "[!ab].txt", path: "b.txt", want: false},
+		{pattern: "\\#file", path: "#file", want: true},
+		{pattern: "# comment", path: "# comment", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.path, func(t *testing.T) {
+			t.Parallel()
+			if got := cli.MatchIgnorePattern(tt.pattern, tt.path, tt.isDir); got != tt.want {
+				t.Errorf("MatchIgnorePattern(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRun_selectFiles(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"a.go":            "a.go\n",
+		"b.yaml":          "b.yaml\n",
+		"c.yml":           "c.yml\n",
+		"d.txt":           "d.txt\n",
+		"sub/g.go":        "sub/g.go\n",
+		"sub/vendor/f.go": "sub/vendor/f.go\n",
+		"vendor/e.go":     "vendor/e.go\n",
+	})
+	t.Chdir(root)
+
+	tests := map[string]struct {
+		args     []string
+		expected string
+		code     int
+	}{
+		"include": {
+			args:     []string{"purl", "-no-filename", "-r", "-include", "*.go", "-filter", "."},
+			expected: "a.go\nsub/g.go\nsub/vendor/f.go\nvendor/e.go\n",
+		},
+		"include and anchored exclude-path": {
+			args:     []string{"purl", "-no-filename", "-r", "-include", "*.go", "-exclude-path", "vendor/**", "-filter", "."},
+			expected: "a.go\nsub/g.go\nsub/vendor/f.go\n",
+		},
+		"exclude-path matches directories at any depth": {
+			args:     []string{"purl", "-no-filename", "-r", "-include", "*.go", "-exclude-path", "vendor", "-filter", "."},
+			expected: "a.go\nsub/g.go\n",
+		},
+		"type": {
+			args:     []string{"purl", "-no-filename", "-r", "-type", "yaml", "-filter", "."},
+			expected: "b.yaml\nc.yml\n",
+		},
+		"multiple types and double star": {
+			args:     []string{"purl", "-no-filename", "-r", "-type", "go,yaml", "-exclude-path", "**/vendor/**", "-filter", "."},
+			expected: "a.go\nb.yaml\nc.yml\nsub/g.go\n",
+		},
+		"explicit files": {
+			args:     []string{"purl", "-no-filename", "-include", "*.txt", "-filter", ".", "a.go", "d.txt"},
+			expected: "d.txt\n",
+		},
+		"unknown type": {
+			args: []string{"purl", "-no-filename", "-r", "-type", "nosuchtype", "-filter", "."},
+			code: cli.ExitCodeFail,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, os.Stdin, false, false)
+
+			if got := cl.Run(tt.args); got != tt.code {
+				t.Fatalf("Expected exit code %d, but got %d; error: %q", tt.code, got, errStream.String())
+			}
+
+			if outStream.String() != tt.expected {
+				t.Errorf("Output=%q, want %q; error: %q", outStream.String(), tt.expected, errStream.String())
+			}
+		})
+	}
+}
+
+func TestRun_binaryFiles(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"a.txt":   "search a\n",
+		"b.bin":   "search\x00b\n",
+		"c.txt":   "search c\n",
+		"d.latin": "search caf\xe9\n",
+	})
+	binPath := filepath.Join(root, "b.bin")
+
+	// a directory of its own keeps -r above from finding it
+	sjisPath := filepath.Join(t.TempDir(), "sjis.txt")
+	if err := os.WriteFile(sjisPath, []byte("search \x93\xfa\x96\x7b\x8c\xea\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		args        []string
+		expected    string
+		expectedErr string
+		code        int
+	}{
+		"skip by default": {
+			args:        []string{"purl", "-no-filename", "-filter", "search", filepath.Join(root, "a.txt"), binPath, filepath.Join(root, "c.txt")},
+			expected:    "search a\nsearch c\n",
+			expectedErr: "Skipping binary file: " + binPath,
+		},
+		"skip with -r": {
+			args:     []string{"purl", "-no-filename", "-r", "-filter", "search", root},
+			expected: "search a\nsearch c\nsearch caf\xe9\n",
+		},
+		"skipped files do not fail": {
+			args:     []string{"purl", "-no-filename", "-fail", "-filter", "search", filepath.Join(root, "a.txt"), binPath},
+			expected: "search a\n",
+		},
+		"shift_jis without -encoding": {
+			args:     []string{"purl", "-fail", "-filter", "search", sjisPath},
+			expected: "search \x93\xfa\x96\x7b\x8c\xea\n",
+		},
+		"text": {
+			args:     []string{"purl", "-no-filename", "-binary=text", "-filter", "search", binPath},
+			expected: "search\x00b\n",
+		},
+		"error": {
+			args:        []string{"purl", "-no-filename", "-binary=error", "-filter", "search", filepath.Join(root, "a.txt"), binPath},
+			expected:    "search a\n",
+			expectedErr: "binary file",
+			code:        cli.ExitCodeFail,
+		},
+		"invalid value": {
+			args:        []string{"purl", "-no-filename", "-binary=nope", "-filter", "search", binPath},
+			expectedErr: "invalid -binary value",
+			code:        cli.ExitCodeFail,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, os.Stdin, false, false)
+
+			if got := cl.Run(tt.args); got != tt.code {
+				t.Fatalf("Expected exit code %d, but got %d; error: %q", tt.code, got, errStream.String())
+			}
+
+			if outStream.String() != tt.expected {
+				t.Errorf("Output=%q, want %q; error: %q", outStream.String(), tt.expected, errStream.String())
+			}
+
+			if !strings.Contains(errStream.String(), tt.expectedErr) {
+				t.Errorf("Error=%q, want to contain %q", errStream.String(), tt.expectedErr)
+			}
+		})
+	}
+}
+
+func TestRun_overwriteBinaryFile(t *testing.T) {
+	const content = "search\x00b\n"
+
+	tests := map[string]struct {
+		args     []string
+		expected string
+	}{
+		"skip": {
+			args:     []string{"purl", "-overwrite", "-replace", "@search@replacement@"},
+			expected: content,
+		},
+		"forced as text": {
+			args:     []string{"purl", "-overwrite", "-binary=text", "-replace", "@search@replacement@"},
+			expected: "replacement\x00b\n",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), "b.bin")
+			if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, os.Stdin, false, false)
+
+			if got := cl.Run(append(tt.args, path)); got != 0 {
+				t.Fatalf("Expected exit code 0, but got %d; error: %q", got, errStream.String())
+			}
+
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.expected {
+				t.Errorf("File=%q, want %q", string(b), tt.expected)
+			}
+		})
+	}
+}
+
+func TestRun_encoding(t *testing.T) {
+	toSJIS := func(s string) string {
+		t.Helper()
+		b, err := japanese.ShiftJIS.NewEncoder().String(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	tests := map[string]struct {
+		args     []string
+		input    string
+		expected string
+	}{
+		"shift_jis overwrite": {
+			args:     []string{"purl", "-encoding", "shift_jis", "-overwrite", "-replace", "@設定=(\\w+)@設定=新しい値@"},
+			input:    toSJIS("名前=テスト\n設定=old\n"),
+			expected: toSJIS("名前=テスト\n設定=新しい値\n"),
+		},
+		"euc-jp overwrite with filter": {
+			args:     []string{"purl", "-encoding", "euc-jp", "-overwrite", "-filter", "^設定"},
+			input:    "\xcc\xbe\xc1\xb0=a\n\xc0\xdf\xc4\xea=b\n",
+			expected: "\xc0\xdf\xc4\xea=b\n",
+		},
+		"utf-8 bom is kept and ^ matches the first line": {
+			args:     []string{"purl", "-overwrite", "-replace", "@^name@NAME@"},
+			input:    "\xef\xbb\xbfname=a\n",
+			expected: "\xef\xbb\xbfNAME=a\n",
+		},
+		"utf-16le bom is detected": {
+			args:     []string{"purl", "-overwrite", "-replace", "@a@b@"},
+			input:    "\xff\xfea\x00\n\x00",
+			expected: "\xff\xfeb\x00\n\x00",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), "input.txt")
+			if err := os.WriteFile(path, []byte(tt.input), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, os.Stdin, false, false)
+
+			if got := cl.Run(append(tt.args, path)); got != 0 {
+				t.Fatalf("Expected exit code 0, but got %d; error: %q", got, errStream.String())
+			}
+
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.expected {
+				t.Errorf("File=%q, want %q", string(b), tt.expected)
+			}
+		})
+	}
+}
+
+func TestRun_encodingStdin(t *testing.T) {
+	outStream, errStream, inputStream := new(bytes.Buffer), new(bytes.Buffer), new(bytes.Buffer)
+	cl := cli.NewCLI(outStream, errStream, inputStream, false, false)
+
+	// "テスト" in Shift_JIS
+	inputStream.WriteString("\x83\x65\x83\x58\x83\x67\n")
+
+	if got := cl.Run([]string{"purl", "-encoding", "sjis", "-replace", "@テ@デ@"}); got != 0 {
+		t.Fatalf("Expected exit code 0, but got %d; error: %q", got, errStream.String())
+	}
+
+	// "デスト" in Shift_JIS
+	if expected := "\x83\x66\x83\x58\x83\x67\n"; outStream.String() != expected {
+		t.Errorf("Output=%q, want %q", outStream.String(), expected)
+	}
+}
+
+func TestRun_unknownEncoding(t *testing.T) {
+	outStream, errStream, inputStream := new(bytes.Buffer), new(bytes.Buffer), new(bytes.Buffer)
+	cl := cli.NewCLI(outStream, errStream, inputStream, false, false)
+
+	if got := cl.Run([]string{"purl", "-encoding", "nope", "-filter", "a"}); got != cli.ExitCodeFail {
+		t.Fatalf("Expected exit code %d, but got %d; error: %q", cli.ExitCodeFail, got, errStream.String())
+	}
+}
+
+func TestRun_chomp(t *testing.T) {
+	tests := map[string]struct {
+		args     []string
+		input    string
+		expected string
+	}{
+		"$ matches before crlf": {
+			args:     []string{"purl", "-chomp", "-replace", "@searchb$@X@"},
+			input:    "searcha searchb\r\nSearcha Searchb\r\n",
+			expected: "searcha X\r\nSearcha Searchb\r\n",
+		},
+		"^$ matches empty lines": {
+			args:     []string{"purl", "-chomp", "-exclude", "^$"},
+			input:    "a\r\n\r\nb\n\nc",
+			expected: "a\r\nb\nc",
+		},
+		"filter empty lines": {
+			args:     []string{"purl", "-chomp", "-filter", "^$"},
+			input:    "a\r\n\r\nb\n",
+			expected: "\r\n",
+		},
+		"replace empty line": {
+			args:     []string{"purl", "-chomp", "-replace", "@^$@-@"},
+			input:    "a\r\n\r\n",
+			expected: "a\r\n-\r\n",
+		},
+		"extract keeps terminators": {
+			args:     []string{"purl", "-chomp", "-extract", `@(\w+)$@$1@`},
+			input:    "a b\r\nc d\n",
+			expected: "b\r\nd\n",
+		},
+		"replace to nothing keeps the line": {
+			args:     []string{"purl", "-chomp", "-replace", "@.+@@"},
+			input:    "a\r\nb\r\n",
+			expected: "\r\n\r\n",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, strings.NewReader(tt.input), false, false)
+
+			if got := cl.Run(tt.args); got != 0 {
+				t.Fatalf("Expected exit code 0, but got %d; error: %q", got, errStream.String())
+			}
+
+			if outStream.String() != tt.expected {
+				t.Errorf("Output=%q, want %q", outStream.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestRun_chompOverwrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test_crlf.txt")
+	copyFile(t, "testdata/test_crlf.txt", path)
+
+	outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+	cl := cli.NewCLI(outStream, errStream, os.Stdin, false, false)
+
+	if got := cl.Run([]string{"purl", "-chomp", "-overwrite", "-i", "-replace", "@searchb$@replaced@", path}); got != 0 {
+		t.Fatalf("Expected exit code 0, but got %d; error: %q", got, errStream.String())
+	}
+
+	if expected := "searcha replaced\r\nSearcha replaced\r\n"; string(readFile(t, path)) != expected {
+		t.Errorf("File=%q, want %q", readFile(t, path), expected)
+	}
+}
+
+func TestRun_bomOutput(t *testing.T) {
+	dir := t.TempDir()
+	bom, plain := filepath.Join(dir, "bom.txt"), filepath.Join(dir, "plain.txt")
+	if err := os.WriteFile(bom, []byte("\xef\xbb\xbfX1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(plain, []byte("X2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		args     []string
+		expected string
+	}{
+		"no match": {
+			args: []string{"purl", "-filter", "nomatch", bom},
+		},
+		"several files": {
+			args:     []string{"purl", "-filter", "X", bom, plain},
+			expected: bom + ":X1\n" + plain + ":X2\n",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, os.Stdin, false, false)
+
+			if got := cl.Run(tt.args); got != 0 {
+				t.Fatalf("Expected exit code 0, but got %d; error: %q", got, errStream.String())
+			}
+
+			if outStream.String() != tt.expected {
+				t.Errorf("Output=%q, want %q", outStream.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestRun_compressedInput(t *testing.T) {
+	zlibBuf := new(bytes.Buffer)
+	zw := zlib.NewWriter(zlibBuf)
+	zw.Write([]byte("2024-01-02 ERROR zlib\n"))
+	zw.Close()
+
+	zlibPath := filepath.Join(t.TempDir(), "test.zz")
+	if err := os.WriteFile(zlibPath, zlibBuf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		args     []string
+		input    []byte
+		expected string
+		code     int
+	}{
+		"gzip": {
+			args:     []string{"purl", "-filter", "ERROR", "testdata/test_log.txt.gz"},
+			expected: "2024-01-02 ERROR db timeout\n2024-01-03 ERROR healthcheck failed\n2024-01-04 ERROR cache miss\n",
+		},
+		"bzip2": {
+			args:     []string{"purl", "-extract", `@ERROR (\w+)@$1@`, "testdata/test_log.txt.bz2"},
+			expected: "db\nhealthcheck\ncache\n",
+		},
+		"zlib": {
+			args:     []string{"purl", "-filter", "ERROR", zlibPath},
+			expected: "2024-01-02 ERROR zlib\n",
+		},
+		"explicit format": {
+			args:     []string{"purl", "-z", "gzip", "-filter", "cache", "testdata/test_log.txt.gz"},
+			expected: "2024-01-04 ERROR cache miss\n",
+		},
+		"no decompression skips as binary": {
+			args:     []string{"purl", "-compression", "none", "-filter", "ERROR", "testdata/test_log.txt.gz"},
+			expected: "",
+		},
+		"stdin": {
+			args:     []string{"purl", "-filter", "cache"},
+			input:    readFile(t, "testdata/test_log.txt.gz"),
+			expected: "2024-01-04 ERROR cache miss\n",
+		},
+		"text starting like bzip2": {
+			args:     []string{"purl", "-filter", "BZh"},
+			input:    []byte("BZh9 is the header of bzip2\n"),
+			expected: "BZh9 is the header of bzip2\n",
+		},
+		"wrong explicit format": {
+			args: []string{"purl", "-z", "gzip", "-filter", "ERROR", "testdata/test_log.txt"},
+			code: cli.ExitCodeFail,
+		},
+		"unknown format": {
+			args: []string{"purl", "-z", "lzma", "-filter", "ERROR", "testdata/test_log.txt"},
+			code: cli.ExitCodeFail,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+			cl := cli.NewCLI(outStream, errStream, bytes.NewReader(tt.input), false, false)
+
+			if got := cl.Run(tt.args); got != tt.code {
+				t.Fatalf("Expected exit code %d, but got %d; error: %q", tt.code, got, errStream.String())
+			}
+
+			if outStream.String() != tt.expected {
+				t.Errorf("Output=%q, want %q; error: %q", outStream.String(), tt.expected, errStream.String())
+			}
+		})
+	}
+}
+
+func TestRun_overwriteCompressedFile(t *testing.T) {
+	t.Run("gzip is compressed again", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(t.TempDir(), "test_log.txt.gz")
+		if err := os.WriteFile(path, readFile(t, "testdata/test_log.txt.gz"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+		cl := cli.NewCLI(outStream, errStream, os.Stdin, false, false)
+
+		if got := cl.Run([]string{"purl", "-overwrite", "-filter", "cache", path}); got != 0 {
+			t.Fatalf("Expected exit code 0, but got %d; error: %q", got, errStream.String())
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("result is not gzip: %v", err)
+		}
+		b, err := io.ReadAll(gr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected := "2024-01-04 ERROR cache miss\n"; string(b) != expected {
+			t.Errorf("File=%q, want %q", string(b), expected)
+		}
+	})
+
+	t.Run("bzip2 is skipped", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		original := readFile(t, "testdata/test_log.txt.bz2")
+		writeFiles(t, dir, map[string]string{
+			"a.txt":            "foo\n",
+			"test_log.txt.bz2": string(original),
+			"c.txt":            "foo\n",
+		})
+		paths := []string{filepath.Join(dir, "a.txt"), filepath.Join(dir, "test_log.txt.bz2"), filepath.Join(dir, "c.txt")}
+
+		outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+		cl := cli.NewCLI(outStream, errStream, os.Stdin, false, false)
+
+		if got := cl.Run(append([]string{"purl", "-overwrite", "-replace", "@foo@bar@"}, paths...)); got != 0 {
+			t.Fatalf("Expected exit code 0, but got %d; error: %q", got, errStream.String())
+		}
+
+		if expected := "Skipping bzip2 compressed file: " + paths[1] + "\n"; errStream.String() != expected {
+			t.Errorf("Error=%q, want %q", errStream.String(), expected)
+		}
+
+		for _, path := range []string{paths[0], paths[2]} {
+			if got := string(readFile(t, path)); got != "bar\n" {
+				t.Errorf("%s=%q, want %q", path, got, "bar\n")
+			}
+		}
+		if !bytes.Equal(readFile(t, paths[1]), original) {
+			t.Errorf("bzip2 file was modified")
+		}
+	})
+}
+
+func TestRun_patchCompressedFile(t *testing.T) {
+	repo := t.TempDir()
+	if err := os.Mkdir(filepath.Join(repo, ".git"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, repo, map[string]string{
+		"a.txt":           "foo\n",
+		"test_log.txt.gz": string(readFile(t, "testdata/test_log.txt.gz")),
+		"c.txt":           "foo\n",
+	})
+	paths := []string{filepath.Join(repo, "a.txt"), filepath.Join(repo, "test_log.txt.gz"), filepath.Join(repo, "c.txt")}
+
+	patch := filepath.Join(t.TempDir(), "out.diff")
+	outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+	cl := cli.NewCLI(outStream, errStream, os.Stdin, false, false)
+
+	if got := cl.Run(append([]string{"purl", "-patch", patch, "-replace", "@foo@bar@"}, paths...)); got != 0 {
+		t.Fatalf("Expected exit code 0, but got %d; error: %q", got, errStream.String())
+	}
+
+	if expected := "Skipping gzip compressed file: " + paths[1] + "\n"; errStream.String() != expected {
+		t.Errorf("Error=%q, want %q", errStream.String(), expected)
+	}
+
+	got := string(readFile(t, patch))
+	for _, name := range []string{"a.txt", "c.txt"} {
+		if !strings.Contains(got, "diff --git a/"+name+" b/"+name+"\n") {
+			t.Errorf("Patch=%q, want a diff of %s", got, name)
+		}
+	}
+	if strings.Contains(got, "test_log") {
+		t.Errorf("Patch=%q, want no diff of the gzip file", got)
+	}
+}
+
+func readFile(t *testing.T, path string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	return b
+}
@@ -0,0 +1,216 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/catatsuy/purl/purl"
+)
+
+// diffProcess runs the pipeline over the whole input and prints a unified
+// diff from the input to the result instead of the result. The diff is
+// printed in UTF-8 whatever the encoding of the input.
+func (c *CLI) diffProcess(p []purl.Stage, name string, inputStream io.Reader, outStream io.Writer) (purl.Stats, error) {
+	original, err := io.ReadAll(inputStream)
+	if err != nil {
+		return purl.Stats{}, fmt.Errorf("failed to read input: %w", err)
+	}
+
+	var result bytes.Buffer
+	stats, err := c.pipelineProcess(p, name, bytes.NewReader(original), &result)
+	if err != nil {
+		return purl.Stats{}, err
+	}
+
+	diff := purl.UnifiedDiff(name, name, original, result.Bytes(), purl.DiffOptions{Context: c.diffContext, Color: c.isColor})
+	if diff == nil {
+		return stats, nil
+	}
+	c.changedFiles++
+
+	if _, err := outStream.Write(diff); err != nil {
+		return purl.Stats{}, fmt.Errorf("error writing to output: %w", err)
+	}
+	return stats, nil
+}
+
+// validateDiff checks the options of -diff.
+func (c *CLI) validateDiff() error {
+	if c.diffContext < 0 {
+		return fmt.Errorf("the number of -U context lines must not be negative")
+	}
+
+	if !c.diffMode {
+		return nil
+	}
+
+	if c.isOverwrite || c.countMode || c.listMatches || c.listNonMatches || c.onlyMatching ||
+		c.contextBefore > 0 || c.contextAfter > 0 || c.lineNumber || c.byteOffset || c.withFilename ||
+		c.jsonOutput || c.reportFormat != "" || c.failMode {
+		return fmt.Errorf("cannot use -overwrite, -count, -l, -L, -o, -A, -B, -C, -n, -b, -H, -json, -report or -fail with -diff")
+	}
+
+	return nil
+}
+
+// patchFile runs the pipeline over a file and adds the changes to the patch
+// of -patch, in the format of git diff. Unlike -diff, the patch is made of
+// the bytes of the file, so it applies to files in any encoding.
+func (c *CLI) patchFile(p []purl.Stage, filePath string, file *os.File) (purl.Stats, error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return purl.Stats{}, fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	// a patch written before and found by -r is not an input
+	if patchInfo, err := os.Stat(c.patchPath); err == nil && os.SameFile(fileInfo, patchInfo) {
+		return purl.Stats{}, nil
+	}
+
+	original, err := io.ReadAll(file)
+	if err != nil {
+		return purl.Stats{}, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	var result bytes.Buffer
+	stats, err := c.processStream(p, filePath, bytes.NewReader(original), &result, true)
+	if err != nil {
+		return purl.Stats{}, err
+	}
+	if bytes.Equal(original, result.Bytes()) {
+		return stats, nil
+	}
+
+	mode := "100644"
+	if fileInfo.Mode()&0o111 != 0 {
+		mode = "100755"
+	}
+
+	path, err := repoPath(filePath)
+	if err != nil {
+		return purl.Stats{}, err
+	}
+	oldName, newName := quotePath("a/"+path), quotePath("b/"+path)
+
+	fmt.Fprintf(&c.patch, "diff --git %s %s\nindex %s..%s %s\n", oldName, newName, blobHash(original), blobHash(result.Bytes()), mode)
+	// like git, end names with a space in the file headers with a tab
+	if strings.Contains(path, " ") {
+		oldName, newName = oldName+"\t", newName+"\t"
+	}
+	c.patch.Write(purl.UnifiedDiff(oldName, newName, original, result.Bytes(), purl.DiffOptions{Context: c.diffContext}))
+
+	return stats, nil
+}
+
+// repoPath returns the path of a file relative to the root of the git
+// repository it is in, or to the current directory outside of a repository.
+func repoPath(filePath string) (string, error) {
+	abs, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve file path: %w", err)
+	}
+
+	root := ""
+	for dir := filepath.Dir(abs); ; dir = filepath.Dir(dir) {
+		// .git is a file in worktrees and submodules
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			root = dir
+			break
+		}
+		if filepath.Dir(dir) == dir {
+			break
+		}
+	}
+	if root == "" {
+		root, err = os.Getwd()
+		if err != nil {
+			return "", fmt.Errorf("failed to get the current directory: %w", err)
+		}
+	}
+
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%s is outside of %s", filePath, root)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// quotePath quotes a path of a patch like git does, when it has control
+// characters, quotes, backslashes or bytes outside of ASCII.
+func quotePath(path string) string {
+	needsQuote := false
+	for i := 0; i < len(path); i++ {
+		if b := path[i]; b < 0x20 || b >= 0x7f || b == '"' || b == '\\' {
+			needsQuote = true
+			break
+		}
+	}
+	if !needsQuote {
+		return path
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(path); i++ {
+		switch ch := path[i]; ch {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(ch)
+		case '\a':
+			b.WriteString(`\a`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\v':
+			b.WriteString(`\v`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if ch < 0x20 || ch >= 0x7f {
+				fmt.Fprintf(&b, `\%03o`, ch)
+			} else {
+				b.WriteByte(ch)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// blobHash returns the object name git gives to a file with the content.
+func blobHash(content []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(content))
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// validatePatch checks the options of -patch.
+func (c *CLI) validatePatch(paths []string) error {
+	if c.patchPath == "" {
+		return nil
+	}
+
+	if len(paths) == 0 {
+		return fmt.Errorf("cannot use -patch option with stdin")
+	}
+
+	if c.isOverwrite || c.diffMode || c.countMode || c.listMatches || c.listNonMatches || c.onlyMatching ||
+		c.contextBefore > 0 || c.contextAfter > 0 || c.lineNumber || c.byteOffset || c.withFilename ||
+		c.jsonOutput || c.reportFormat != "" || c.failMode {
+		return fmt.Errorf("cannot use -overwrite, -diff, -count, -l, -L, -o, -A, -B, -C, -n, -b, -H, -json, -report or -fail with -patch")
+	}
+
+	return nil
+}
@@ -3,16 +3,46 @@ package cli
 import (
 	"io"
 	"regexp"
+
+	"github.com/catatsuy/purl/purl"
 )
 
+func ParseScript(r io.Reader) ([]string, error) {
+	ops, err := parseScript(r)
+	if err != nil {
+		return nil, err
+	}
+
+	exprs := make([]string, 0, len(ops))
+	for _, op := range ops {
+		exprs = append(exprs, op.expr)
+	}
+	return exprs, nil
+}
+
+// ReplaceProcess runs a single Replacer over inputStream like the pipeline of
+// -replace, and reports whether it replaced anything.
 func (c *CLI) ReplaceProcess(searchRe *regexp.Regexp, replacement []byte, inputStream io.Reader) (bool, error) {
-	return c.replaceProcess(searchRe, replacement, inputStream)
+	stats, err := c.pipelineProcess([]purl.Stage{purl.NewReplacer(searchRe, replacement, purl.ReplacerOptions{})}, stdinName, inputStream, c.outStream)
+	return stats.Found, err
 }
 
+// FilterProcess runs a single Filter over inputStream like the pipeline of
+// -filter and -exclude, and reports whether any line matched.
 func (c *CLI) FilterProcess(filters []*regexp.Regexp, notFilters []*regexp.Regexp, inputStream io.Reader) (bool, error) {
-	return c.filterProcess(filters, notFilters, inputStream)
+	f := purl.NewFilter(filters, notFilters, purl.FilterOptions{Color: c.isColor})
+	stats, err := c.pipelineProcess([]purl.Stage{f}, stdinName, inputStream, c.outStream)
+	return stats.Found, err
 }
 
 func CompileRegexps(rawPatterns []string, ignoreCase bool) ([]*regexp.Regexp, error) {
-	return compileRegexps(rawPatterns, ignoreCase)
+	return purl.CompileLinePatterns(rawPatterns, ignoreCase)
+}
+
+func MatchIgnorePattern(pattern, path string, isDir bool) bool {
+	rule, ok := parseIgnoreRule("/base", pattern)
+	if !ok {
+		return false
+	}
+	return isIgnored([]ignoreRule{rule}, "/base/"+path, isDir)
 }
@@ -0,0 +1,208 @@
+package cli
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// fileTypes maps the names accepted by -type to file name globs.
+var fileTypes = map[string][]string{
+	"c":        {"*.c", "*.h"},
+	"cpp":      {"*.cpp", "*.cc", "*.cxx", "*.hpp", "*.hh", "*.hxx"},
+	"css":      {"*.css", "*.scss", "*.sass"},
+	"csv":      {"*.csv", "*.tsv"},
+	"go":       {"*.go"},
+	"html":     {"*.html", "*.htm"},
+	"java":     {"*.java"},
+	"js":       {"*.js", "*.mjs", "*.cjs", "*.jsx"},
+	"json":     {"*.json", "*.jsonl"},
+	"log":      {"*.log"},
+	"markdown": {"*.md", "*.markdown"},
+	"md":       {"*.md", "*.markdown"},
+	"php":      {"*.php"},
+	"py":       {"*.py"},
+	"rb":       {"*.rb"},
+	"rust":     {"*.rs"},
+	"sh":       {"*.sh", "*.bash", "*.zsh"},
+	"sql":      {"*.sql"},
+	"toml":     {"*.toml"},
+	"ts":       {"*.ts", "*.tsx", "*.mts", "*.cts"},
+	"txt":      {"*.txt"},
+	"xml":      {"*.xml"},
+	"yaml":     {"*.yaml", "*.yml"},
+}
+
+// pathGlob is a compiled -include or -exclude-path pattern.
+type pathGlob struct {
+	re *regexp.Regexp
+}
+
+// compilePathGlob compiles a glob for matching file paths. Like .gitignore, a
+// glob without a slash matches a name at any depth, and a glob with a slash is
+// matched against the path relative to the current directory.
+func compilePathGlob(glob string) (pathGlob, error) {
+	glob = filepath.ToSlash(glob)
+	anchored := strings.Contains(strings.TrimSuffix(glob, "/"), "/")
+	glob = strings.TrimPrefix(strings.TrimSuffix(glob, "/"), "./")
+	glob = strings.TrimPrefix(glob, "/")
+
+	expr := globToRegexp(glob)
+	if !anchored && !strings.HasPrefix(glob, "**/") {
+		expr = "(?:.*/)?" + expr
+	}
+
+	re, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return pathGlob{}, fmt.Errorf("invalid glob %q: %w", glob, err)
+	}
+	return pathGlob{re: re}, nil
+}
+
+// match reports whether the path or one of its parent directories matches,
+// so that "vendor" or "vendor/**" covers every file below vendor.
+func (g pathGlob) match(rel string) bool {
+	for {
+		if g.re.MatchString(rel) {
+			return true
+		}
+
+		i := strings.LastIndexByte(rel, '/')
+		if i < 0 {
+			return false
+		}
+		rel = rel[:i]
+	}
+}
+
+// selectFiles keeps the files that match -include or -type, if given, and do
+// not match -exclude-path.
+func (c *CLI) selectFiles(paths []string) ([]string, error) {
+	if len(c.includeGlobs) == 0 && len(c.excludePathGlobs) == 0 && len(c.fileTypes) == 0 {
+		return paths, nil
+	}
+
+	var includes, excludes []pathGlob
+
+	for _, value := range c.fileTypes {
+		for name := range strings.SplitSeq(value, ",") {
+			name = strings.TrimSpace(name)
+			globs, ok := fileTypes[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown file type %q (known types: %s)", name, strings.Join(slices.Sorted(maps.Keys(fileTypes)), ", "))
+			}
+			for _, glob := range globs {
+				g, err := compilePathGlob(glob)
+				if err != nil {
+					return nil, err
+				}
+				includes = append(includes, g)
+			}
+		}
+	}
+
+	for _, glob := range c.includeGlobs {
+		g, err := compilePathGlob(glob)
+		if err != nil {
+			return nil, err
+		}
+		includes = append(includes, g)
+	}
+
+	for _, glob := range c.excludePathGlobs {
+		g, err := compilePathGlob(glob)
+		if err != nil {
+			return nil, err
+		}
+		excludes = append(excludes, g)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current directory: %w", err)
+	}
+
+	var selected []string
+	for _, path := range paths {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+
+		rel, err := filepath.Rel(wd, absPath)
+		if err != nil {
+			rel = absPath
+		}
+		rel = filepath.ToSlash(rel)
+
+		if len(includes) > 0 && !slices.ContainsFunc(includes, func(g pathGlob) bool { return g.match(rel) }) {
+			continue
+		}
+
+		if slices.ContainsFunc(excludes, func(g pathGlob) bool { return g.match(rel) }) {
+			continue
+		}
+
+		selected = append(selected, path)
+	}
+
+	return selected, nil
+}
+
+// globToRegexp converts a glob pattern to a regular expression. "*" and "?"
+// do not match "/", while "**" matches any number of directories.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(glob); i++ {
+		ch := glob[i]
+		switch ch {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**") {
+				atStart := i == 0 || glob[i-1] == '/'
+				rest := glob[i+2:]
+				switch {
+				case atStart && strings.HasPrefix(rest, "/"):
+					// "**/" matches zero or more directories
+					b.WriteString("(?:.*/)?")
+					i += 2
+				case atStart && rest == "":
+					b.WriteString(".*")
+					i++
+				default:
+					b.WriteString("[^/]*")
+					i++
+				}
+				continue
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,98 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/catatsuy/purl/purl"
+)
+
+// jsonMatch is the object printed by -json for every match.
+type jsonMatch struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+	Line int    `json:"line"`
+	// Offset is the byte offset of the match in the input
+	Offset int64  `json:"offset"`
+	Text   string `json:"text"`
+	Match  string `json:"match"`
+	// Groups are the capture groups by number, starting at 1, with null for
+	// a group that did not match
+	Groups []*string          `json:"groups"`
+	Named  map[string]*string `json:"named"`
+}
+
+// jsonFile is the number of matches in an input, in the summary of -json.
+type jsonFile struct {
+	Path    string `json:"path"`
+	Matches int    `json:"matches"`
+}
+
+// jsonSummary is the object printed by -json after every input is processed.
+type jsonSummary struct {
+	Type    string     `json:"type"`
+	Files   []jsonFile `json:"files"`
+	Matches int        `json:"matches"`
+}
+
+// writeJSONMatches prints an object for every match in a line kept by the
+// pipeline, and returns the number of matches.
+func (c *CLI) writeJSONMatches(w io.Writer, name string, chunk purl.Chunk) (int, error) {
+	if chunk.Kind != purl.ChunkText {
+		return 0, nil
+	}
+
+	line := chunk.Data
+	text := bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+
+	matches := c.matcher.FindMatches(line)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for _, m := range matches {
+		obj := jsonMatch{
+			Type:   "match",
+			Path:   name,
+			Line:   chunk.Line,
+			Offset: chunk.Offset + int64(m.Start),
+			Text:   string(text),
+			Match:  string(line[m.Start:m.End]),
+			Groups: make([]*string, 0, len(m.Groups)),
+			Named:  map[string]*string{},
+		}
+		for _, g := range m.Groups {
+			var value *string
+			if g.Start >= 0 {
+				s := string(line[g.Start:g.End])
+				value = &s
+			}
+			obj.Groups = append(obj.Groups, value)
+			if g.Name != "" {
+				obj.Named[g.Name] = value
+			}
+		}
+
+		if err := enc.Encode(obj); err != nil {
+			return 0, fmt.Errorf("error writing to output: %w", err)
+		}
+	}
+
+	return len(matches), nil
+}
+
+// printJSONSummary prints the summary object of -json.
+func (c *CLI) printJSONSummary() {
+	summary := jsonSummary{Type: "summary", Files: c.jsonFiles}
+	if summary.Files == nil {
+		summary.Files = []jsonFile{}
+	}
+	for _, f := range c.jsonFiles {
+		summary.Matches += f.Matches
+	}
+
+	enc := json.NewEncoder(c.outStream)
+	enc.SetEscapeHTML(false)
+	// there is nothing left to do about a write error
+	enc.Encode(summary)
+}
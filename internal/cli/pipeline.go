@@ -0,0 +1,566 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/catatsuy/purl/purl"
+)
+
+type operationKind int
+
+const (
+	operationReplace operationKind = iota
+	operationFilter
+	operationExclude
+	operationExtract
+	operationWhere
+)
+
+// operation is a single -replace, -filter, -exclude, -extract or -where option, or a
+// command of a script file, in the order it was given on the command line.
+type operation struct {
+	kind       operationKind
+	expr       string
+	ignoreCase bool
+	// message and severity describe the matches of the operation in the
+	// output of -report
+	message  string
+	severity string
+}
+
+// operationFlag records every occurrence of an option into a shared list so
+// that the pipeline keeps the command line order.
+type operationFlag struct {
+	operations *[]operation
+	kind       operationKind
+}
+
+func (f *operationFlag) String() string {
+	if f.operations == nil {
+		return ""
+	}
+
+	values := make([]string, 0, len(*f.operations))
+	for _, op := range *f.operations {
+		if op.kind == f.kind {
+			values = append(values, op.expr)
+		}
+	}
+	return fmt.Sprint(values)
+}
+
+func (f *operationFlag) Set(value string) error {
+	*f.operations = append(*f.operations, operation{kind: f.kind, expr: value})
+	return nil
+}
+
+// reportFlag sets the -message or the -severity of the operation given right
+// before it.
+type reportFlag struct {
+	operations *[]operation
+	severity   bool
+}
+
+func (f *reportFlag) String() string {
+	return ""
+}
+
+func (f *reportFlag) Set(value string) error {
+	ops := *f.operations
+	if len(ops) == 0 || ops[len(ops)-1].kind == operationExclude {
+		return fmt.Errorf("must follow -filter, -where, -extract or -replace")
+	}
+
+	op := &ops[len(ops)-1]
+	if !f.severity {
+		op.message = value
+		return nil
+	}
+
+	switch value {
+	case severityError, severityWarning, severityNote:
+		op.severity = value
+		return nil
+	}
+	return fmt.Errorf("invalid severity %q. Use %q, %q or %q", value, severityError, severityWarning, severityNote)
+}
+
+// buildPipeline compiles the operations into stages. Adjacent -filter,
+// -exclude and -where options are combined into one stage so that multiple
+// -filter options keep matching any of the patterns, or all with -all.
+// Context lines and -o apply to the matches of the last -filter. With
+// -report, only -exclude makes stages, and the other operations are compiled
+// into rules.
+func (c *CLI) buildPipeline() ([]purl.Stage, error) {
+	var stages []purl.Stage
+
+	lastFilter := -1
+	for i, op := range c.operations {
+		if op.isFilter() {
+			lastFilter = i
+		}
+	}
+
+	c.countStage = -1
+
+	patterns, err := c.compileNamedPatterns()
+	if err != nil {
+		return nil, err
+	}
+
+	on, err := purl.CompileLinePatterns(c.guardOn, c.ignoreCase)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -on pattern: %w", err)
+	}
+	notOn, err := purl.CompileLinePatterns(c.guardNotOn, c.ignoreCase)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -not-on pattern: %w", err)
+	}
+
+	fields, err := c.fieldOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	lookup := func(name string) (*regexp.Regexp, error) {
+		if re, ok := patterns[name]; ok {
+			return re, nil
+		}
+		// a name without -p stands for itself
+		return purl.CompilePattern("(?m)"+regexp.QuoteMeta(name), c.ignoreCase)
+	}
+
+	// rules match the operations one by one for -report
+	addRule := func(op operation, m purl.Matcher) {
+		if c.reportFormat != "" {
+			c.rules = append(c.rules, newRule(len(c.rules), op, m))
+		}
+	}
+
+	// matchStage is the last stage searching for something, whose matches
+	// -json prints
+	matchStage := -1
+
+	for i := 0; i < len(c.operations); i++ {
+		op := c.operations[i]
+
+		switch op.kind {
+		case operationReplace:
+			searchRe, replacement, err := compileExpression(op.expr, c.ignoreCase || op.ignoreCase)
+			if err != nil {
+				return nil, fmt.Errorf("invalid -replace expression: %w", err)
+			}
+			if c.reportFormat != "" {
+				// -report shows what would change without changing it
+				addRule(op, purl.NewFilter([]*regexp.Regexp{searchRe}, nil, purl.FilterOptions{Fields: fields}))
+				continue
+			}
+			c.countStage = len(stages)
+			stages = append(stages, purl.NewReplacer(searchRe, []byte(replacement), purl.ReplacerOptions{On: on, NotOn: notOn, Fields: fields}))
+		case operationExtract:
+			searchRe, replacement, err := compileExpression(op.expr, c.ignoreCase || op.ignoreCase)
+			if err != nil {
+				return nil, fmt.Errorf("invalid -extract expression: %w", err)
+			}
+			if c.reportFormat != "" {
+				addRule(op, purl.NewFilter([]*regexp.Regexp{searchRe}, nil, purl.FilterOptions{Fields: fields}))
+				continue
+			}
+			c.countStage = len(stages)
+			matchStage = len(stages)
+			if c.jsonOutput {
+				// -json prints the capture groups instead of the template
+				stages = append(stages, purl.NewFilter([]*regexp.Regexp{searchRe}, nil, purl.FilterOptions{Fields: fields}))
+				continue
+			}
+			stages = append(stages, purl.NewExtractor(searchRe, replacement, purl.ExtractorOptions{Fields: fields}))
+		case operationFilter, operationExclude, operationWhere:
+			var filters, excludes []*regexp.Regexp
+			var conditions []string
+			opts := purl.FilterOptions{MatchAll: c.matchAll, Fields: fields}
+			for ; i < len(c.operations); i++ {
+				op := c.operations[i]
+				if !op.isFilter() && op.kind != operationExclude {
+					break
+				}
+
+				if i == lastFilter {
+					opts.Before, opts.After = c.contextBefore, c.contextAfter
+					opts.ContextExcluded = c.contextExcluded
+					opts.OnlyMatching = c.onlyMatching
+				}
+
+				if op.kind == operationWhere {
+					conditions = append(conditions, "("+op.expr+")")
+					if c.reportFormat != "" {
+						where, err := purl.ParseCondition(op.expr, lookup)
+						if err != nil {
+							return nil, fmt.Errorf("invalid -where expression: %w", err)
+						}
+						addRule(op, purl.NewFilter(nil, nil, purl.FilterOptions{Where: where, Fields: fields}))
+					}
+					continue
+				}
+
+				res, err := purl.CompileLinePatterns([]string{op.expr}, c.ignoreCase || op.ignoreCase)
+				if err != nil {
+					return nil, err
+				}
+
+				if op.kind == operationFilter {
+					addRule(op, purl.NewFilter(res, nil, purl.FilterOptions{Fields: fields}))
+					filters = append(filters, res...)
+				} else {
+					excludes = append(excludes, res...)
+				}
+			}
+
+			// highlighting is only useful for what is finally printed
+			last := i == len(c.operations)
+			i--
+
+			if len(conditions) > 0 {
+				where, err := purl.ParseCondition(strings.Join(conditions, " and "), lookup)
+				if err != nil {
+					return nil, fmt.Errorf("invalid -where expression: %w", err)
+				}
+				opts.Where = where
+			}
+
+			if c.reportFormat != "" {
+				// every rule is checked on its own on the lines left by
+				// -exclude
+				filters, opts.Where = nil, nil
+			}
+
+			// colors would break the quoting of records and JSON, and show up
+			// as changes in -diff
+			opts.Color = c.isColor && last && c.csvComma() == 0 && !c.jsonl && !c.jsonOutput && c.reportFormat == "" && !c.diffMode
+			if len(filters) > 0 || opts.Where != nil {
+				c.countStage = len(stages)
+				matchStage = len(stages)
+			}
+			stages = append(stages, purl.NewFilter(filters, excludes, opts))
+		}
+	}
+
+	if c.reportFormat != "" && len(stages) == 0 {
+		// rules are checked on every line when there is no -exclude
+		stages = append(stages, purl.NewFilter(nil, nil, purl.FilterOptions{}))
+	}
+
+	if err := c.buildScope(); err != nil {
+		return nil, err
+	}
+
+	if c.jsonOutput {
+		// validateInput makes sure that there is a stage searching for something
+		c.matcher = stages[matchStage].(purl.Matcher)
+	}
+
+	if c.jsonl {
+		return c.wrapJSON(stages)
+	}
+
+	return stages, nil
+}
+
+// wrapJSON makes the stages work on the values of -key in JSON lines. Only the
+// first stage reports lines that are not JSON, as the others see the same
+// lines.
+func (c *CLI) wrapJSON(stages []purl.Stage) ([]purl.Stage, error) {
+	keys := make([]purl.JSONPath, 0, len(c.jsonKeys))
+	for _, k := range c.jsonKeys {
+		path, err := purl.ParseJSONPath(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -key value: %w", err)
+		}
+		keys = append(keys, path)
+	}
+
+	for i, s := range stages {
+		opts := purl.JSONOptions{Keys: keys}
+		if i == 0 && c.invalidJSON == invalidJSONReport {
+			opts.OnInvalid = func(line purl.Chunk) {
+				fmt.Fprintf(c.errStream, "Not JSON: %s:%d\n", c.inputName, line.Line)
+			}
+		}
+		stages[i] = purl.NewJSONStage(s, opts)
+	}
+	return stages, nil
+}
+
+// fieldOptions returns the field of -F and -field. -field alone splits on
+// blanks like awk.
+func (c *CLI) fieldOptions() (purl.FieldOptions, error) {
+	if c.fieldSeparator == "" && c.field == 0 {
+		return purl.FieldOptions{}, nil
+	}
+
+	separator := " "
+	if c.fieldSeparator != "" {
+		separator = unescapeString(c.fieldSeparator)
+	}
+
+	sep, err := purl.ParseFieldSeparator(separator)
+	if err != nil {
+		return purl.FieldOptions{}, fmt.Errorf("invalid -F separator: %w", err)
+	}
+	return purl.FieldOptions{Separator: sep, Field: c.field}, nil
+}
+
+// buildScope compiles -from, -after, -to, -before and -lines into the scope
+// of the operations. Lines out of scope are kept unchanged when every
+// operation is a -replace, and dropped otherwise.
+func (c *CLI) buildScope() error {
+	var scopes []purl.Scope
+
+	if len(c.lineSpecs) > 0 {
+		var spans []purl.LineSpan
+		for _, spec := range c.lineSpecs {
+			s, err := purl.ParseLineSpans(spec)
+			if err != nil {
+				return fmt.Errorf("invalid -lines value: %w", err)
+			}
+			spans = append(spans, s...)
+		}
+		scopes = append(scopes, purl.NewLineRange(spans...))
+	}
+
+	start, excludeStart := c.rangeFrom, false
+	if c.rangeAfter != "" {
+		start, excludeStart = c.rangeAfter, true
+	}
+	end, excludeEnd := c.rangeTo, false
+	if c.rangeBefore != "" {
+		end, excludeEnd = c.rangeBefore, true
+	}
+
+	if start != "" || end != "" {
+		r, err := c.compileRange(start, end, excludeStart, excludeEnd)
+		if err != nil {
+			return err
+		}
+		scopes = append(scopes, r)
+	}
+
+	switch len(scopes) {
+	case 0:
+		return nil
+	case 1:
+		c.scope = scopes[0]
+	default:
+		c.scope = purl.Intersect(scopes...)
+	}
+
+	c.passThrough = true
+	for _, op := range c.operations {
+		if op.kind != operationReplace {
+			c.passThrough = false
+		}
+	}
+
+	return nil
+}
+
+func (c *CLI) compileRange(start, end string, excludeStart, excludeEnd bool) (*purl.Range, error) {
+	compile := func(pattern string) (*regexp.Regexp, error) {
+		if pattern == "" {
+			return nil, nil
+		}
+		res, err := purl.CompileLinePatterns([]string{pattern}, c.ignoreCase)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range pattern: %w", err)
+		}
+		return res[0], nil
+	}
+
+	startRe, err := compile(start)
+	if err != nil {
+		return nil, err
+	}
+	endRe, err := compile(end)
+	if err != nil {
+		return nil, err
+	}
+
+	return purl.NewRange(startRe, endRe, purl.RangeOptions{ExcludeStart: excludeStart, ExcludeEnd: excludeEnd}), nil
+}
+
+// isFilter reports whether the operation selects lines by matching them.
+func (op operation) isFilter() bool {
+	return op.kind == operationFilter || op.kind == operationWhere
+}
+
+// compileNamedPatterns compiles the -p options used by -where.
+func (c *CLI) compileNamedPatterns() (map[string]*regexp.Regexp, error) {
+	patterns := make(map[string]*regexp.Regexp, len(c.namedPatterns))
+	for _, def := range c.namedPatterns {
+		name, pattern, ok := strings.Cut(def, "=")
+		if !ok || name == "" || strings.ContainsAny(name, " \t()!&|") {
+			return nil, fmt.Errorf("invalid -p value %q. Use \"name=pattern\"", def)
+		}
+
+		res, err := purl.CompileLinePatterns([]string{pattern}, c.ignoreCase)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -p pattern %q: %w", name, err)
+		}
+		patterns[name] = res[0]
+	}
+	return patterns, nil
+}
+
+// compileExpression splits an expression like "@search@replace@" and compiles
+// the search pattern.
+func compileExpression(expr string, ignoreCase bool) (*regexp.Regexp, string, error) {
+	pattern, replacement, err := purl.ParseExpression(expr)
+	if err != nil {
+		return nil, "", err
+	}
+
+	searchRe, err := purl.CompilePattern(pattern, ignoreCase)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return searchRe, unescapeString(replacement), nil
+}
+
+// pipelineProcess reads data from inputStream, runs it through the stages,
+// and writes the result to outStream, prefixed as requested by -H, -n and -b.
+// In line mode, or when every stage works on single lines, it processes input
+// line by line without changing newline characters.
+// Otherwise it reads and processes the entire input at once. With -csv or
+// -tsv it operates on the fields of records instead.
+func (c *CLI) pipelineProcess(stages []purl.Stage, name string, inputStream io.Reader, outStream io.Writer) (purl.Stats, error) {
+	if comma := c.csvComma(); comma != 0 {
+		opts := purl.CSVOptions{Comma: comma, Header: c.csvHeader, Columns: c.csvColumns}
+		return purl.NewCSVPipeline(opts, stages...).Process(context.Background(), inputStream, outStream)
+	}
+
+	c.inputName = name
+
+	opts := purl.PipelineOptions{LineMode: c.lineMode, Chomp: c.chomp, Scope: c.scope, PassThrough: c.passThrough}
+
+	if c.reportFormat != "" {
+		opts.LineMode = true
+		c.reportFiles = append(c.reportFiles, name)
+		found := 0
+		stats, err := purl.NewPipeline(opts, stages...).Run(context.Background(), inputStream, func(chunk purl.Chunk) error {
+			n, err := c.reportChunk(outStream, name, chunk)
+			found += n
+			return err
+		})
+		// the input matched when any rule matched
+		stats.Matched = found
+		stats.Found = found > 0
+		return stats, err
+	}
+
+	if c.jsonOutput {
+		opts.LineMode = true
+		matches := 0
+		stats, err := purl.NewPipeline(opts, stages...).Run(context.Background(), inputStream, func(chunk purl.Chunk) error {
+			n, err := c.writeJSONMatches(outStream, name, chunk)
+			matches += n
+			return err
+		})
+		c.jsonFiles = append(c.jsonFiles, jsonFile{Path: name, Matches: matches})
+		return stats, err
+	}
+
+	p := purl.NewPipeline(opts, stages...)
+
+	// like grep, groups of context lines from different inputs are separated
+	separate := c.contextPrinted
+	return p.Run(context.Background(), inputStream, func(chunk purl.Chunk) error {
+		if c.contextBefore > 0 || c.contextAfter > 0 {
+			if separate {
+				separator := purl.Chunk{Data: []byte("--"), EOL: []byte("\n"), Kind: purl.ChunkSeparator}
+				if _, err := outStream.Write(c.formatChunk(name, separator)); err != nil {
+					return fmt.Errorf("error writing to output: %w", err)
+				}
+				separate = false
+			}
+			c.contextPrinted = true
+		}
+
+		if _, err := outStream.Write(c.formatChunk(name, chunk)); err != nil {
+			return fmt.Errorf("error writing to output: %w", err)
+		}
+		return nil
+	})
+}
+
+const (
+	colorFilename  = "\x1b[35m"
+	colorNumber    = "\x1b[32m"
+	colorSeparator = "\x1b[36m"
+	colorReset     = "\x1b[0m"
+)
+
+// formatChunk returns the output of a chunk. With -H, -n or -b every line is
+// prefixed like grep, using ':' after matched lines and '-' after context
+// lines. The positions of later lines of a chunk are counted from the start
+// of the chunk.
+func (c *CLI) formatChunk(name string, chunk purl.Chunk) []byte {
+	if !(c.withFilename || c.lineNumber || c.byteOffset) || chunk.Kind == purl.ChunkSeparator {
+		if c.isColor && chunk.Kind == purl.ChunkSeparator {
+			return fmt.Appendf(nil, "%s%s%s%s", colorSeparator, chunk.Data, colorReset, chunk.EOL)
+		}
+		return append(chunk.Data[:len(chunk.Data):len(chunk.Data)], chunk.EOL...)
+	}
+
+	sep := ":"
+	if chunk.Kind == purl.ChunkContext {
+		sep = "-"
+	}
+
+	field := func(b []byte, color, value string) []byte {
+		if c.isColor {
+			return fmt.Appendf(b, "%s%s%s%s%s%s", color, value, colorReset, colorSeparator, sep, colorReset)
+		}
+		return fmt.Appendf(b, "%s%s", value, sep)
+	}
+
+	lines := slices.Collect(bytes.Lines(chunk.Data))
+	if len(lines) == 0 {
+		// an empty line chomped by the pipeline
+		lines = [][]byte{nil}
+	}
+
+	out := make([]byte, 0, len(chunk.Data)+len(chunk.EOL)+32)
+	lineNo, offset := chunk.Line, chunk.Offset
+	for _, line := range lines {
+		if c.withFilename {
+			out = field(out, colorFilename, name)
+		}
+		if c.lineNumber {
+			out = field(out, colorNumber, strconv.Itoa(lineNo))
+		}
+		if c.byteOffset {
+			out = field(out, colorNumber, strconv.FormatInt(offset, 10))
+		}
+		out = append(out, line...)
+
+		lineNo++
+		offset += int64(len(line))
+	}
+
+	return append(out, chunk.EOL...)
+}
+
+// colorName returns a file name for printing, colored like the prefix of -H.
+func (c *CLI) colorName(name string) string {
+	if c.isColor {
+		return colorFilename + name + colorReset
+	}
+	return name
+}
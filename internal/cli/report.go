@@ -0,0 +1,301 @@
+package cli
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/catatsuy/purl/purl"
+)
+
+const (
+	reportSARIF    = "sarif"
+	reportGitHub   = "github"
+	reportJUnit    = "junit"
+	reportQuickfix = "quickfix"
+)
+
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+	severityNote    = "note"
+)
+
+var operationNames = map[operationKind]string{
+	operationReplace: "replace",
+	operationFilter:  "filter",
+	operationExclude: "exclude",
+	operationExtract: "extract",
+	operationWhere:   "where",
+}
+
+// rule is an operation whose matches are reported by -report.
+type rule struct {
+	id       string
+	message  string
+	severity string
+	matcher  purl.Matcher
+}
+
+// newRule returns the rule of an operation. The message defaults to the
+// option itself, such as "-filter TODO".
+func newRule(index int, op operation, m purl.Matcher) rule {
+	r := rule{id: fmt.Sprintf("purl%d", index+1), message: op.message, severity: op.severity, matcher: m}
+	if r.message == "" {
+		r.message = fmt.Sprintf("-%s %s", operationNames[op.kind], op.expr)
+	}
+	if r.severity == "" {
+		r.severity = severityError
+	}
+	return r
+}
+
+// finding is a match of a rule.
+type finding struct {
+	rule int
+	path string
+	line int
+	// column and endColumn count characters from 1, endColumn being the
+	// first character after the match
+	column, endColumn int
+	text              string
+}
+
+// reportChunk reports the matches of every rule in a line kept by the
+// pipeline, and returns the number of matches. GitHub annotations and
+// quickfix lines are written right away, the other formats when every input
+// is processed.
+func (c *CLI) reportChunk(w io.Writer, name string, chunk purl.Chunk) (int, error) {
+	if chunk.Kind != purl.ChunkText {
+		return 0, nil
+	}
+
+	found := 0
+	line := chunk.Data
+	for i, r := range c.rules {
+		for _, m := range r.matcher.FindMatches(line) {
+			f := finding{
+				rule:      i,
+				path:      name,
+				line:      chunk.Line,
+				column:    utf8.RuneCount(line[:m.Start]) + 1,
+				endColumn: utf8.RuneCount(line[:m.End]) + 1,
+				text:      string(line[m.Start:m.End]),
+			}
+
+			var err error
+			switch c.reportFormat {
+			case reportGitHub:
+				_, err = fmt.Fprintf(w, "::%s file=%s,line=%d,col=%d,endColumn=%d,title=purl::%s\n",
+					githubCommand(r.severity), githubEscapeProperty(f.path), f.line, f.column, f.endColumn, githubEscape(r.message))
+			case reportQuickfix:
+				_, err = fmt.Fprintf(w, "%s:%d:%d: %s: %s\n", f.path, f.line, f.column, r.severity, r.message)
+			default:
+				c.findings = append(c.findings, f)
+			}
+			if err != nil {
+				return found, fmt.Errorf("error writing to output: %w", err)
+			}
+			found++
+		}
+	}
+	return found, nil
+}
+
+// printReport writes the SARIF or JUnit report of the findings.
+func (c *CLI) printReport() error {
+	switch c.reportFormat {
+	case reportSARIF:
+		return c.printSARIF()
+	case reportJUnit:
+		return c.printJUnit()
+	}
+	return nil
+}
+
+func githubCommand(severity string) string {
+	if severity == severityNote {
+		return "notice"
+	}
+	return severity
+}
+
+// githubEscape escapes the message of a workflow command.
+func githubEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// githubEscapeProperty escapes a property of a workflow command.
+func githubEscapeProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool       sarifTool     `json:"tool"`
+	ColumnKind string        `json:"columnKind"`
+	Results    []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	Version        string      `json:"version,omitempty"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID                   string             `json:"id"`
+	ShortDescription     sarifMessage       `json:"shortDescription"`
+	DefaultConfiguration sarifConfiguration `json:"defaultConfiguration"`
+}
+
+type sarifConfiguration struct {
+	Level string `json:"level"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	RuleIndex int             `json:"ruleIndex"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           sarifRegion           `json:"region"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int          `json:"startLine"`
+	StartColumn int          `json:"startColumn"`
+	EndColumn   int          `json:"endColumn"`
+	Snippet     sarifMessage `json:"snippet"`
+}
+
+// printSARIF writes the findings as a SARIF 2.1.0 log.
+func (c *CLI) printSARIF() error {
+	driver := sarifDriver{Name: "purl", Version: c.appVersion, InformationURI: "https://github.com/catatsuy/purl", Rules: []sarifRule{}}
+	for _, r := range c.rules {
+		driver.Rules = append(driver.Rules, sarifRule{
+			ID:                   r.id,
+			ShortDescription:     sarifMessage{Text: r.message},
+			DefaultConfiguration: sarifConfiguration{Level: r.severity},
+		})
+	}
+
+	run := sarifRun{Tool: sarifTool{Driver: driver}, ColumnKind: "unicodeCodePoints", Results: []sarifResult{}}
+	for _, f := range c.findings {
+		r := c.rules[f.rule]
+		run.Results = append(run.Results, sarifResult{
+			RuleID:    r.id,
+			RuleIndex: f.rule,
+			Level:     r.severity,
+			Message:   sarifMessage{Text: r.message},
+			Locations: []sarifLocation{{PhysicalLocation: sarifPhysicalLocation{
+				ArtifactLocation: sarifArtifactLocation{URI: filepath.ToSlash(f.path)},
+				Region:           sarifRegion{StartLine: f.line, StartColumn: f.column, EndColumn: f.endColumn, Snippet: sarifMessage{Text: f.text}},
+			}}},
+		})
+	}
+
+	log := sarifLog{Version: "2.1.0", Schema: "https://json.schemastore.org/sarif-2.1.0.json", Runs: []sarifRun{run}}
+
+	enc := json.NewEncoder(c.outStream)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(log); err != nil {
+		return fmt.Errorf("error writing to output: %w", err)
+	}
+	return nil
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// printJUnit writes the findings as JUnit XML, with a test case for every
+// rule in every input. A test case fails when the rule matched in the input.
+func (c *CLI) printJUnit() error {
+	suite := junitTestSuite{Name: "purl"}
+	for _, path := range c.reportFiles {
+		for i, r := range c.rules {
+			tc := junitTestCase{Name: r.message, Classname: path}
+
+			var details strings.Builder
+			n := 0
+			for _, f := range c.findings {
+				if f.rule == i && f.path == path {
+					n++
+					fmt.Fprintf(&details, "%s:%d:%d: %s\n", f.path, f.line, f.column, f.text)
+				}
+			}
+			if n > 0 {
+				tc.Failure = &junitFailure{Message: fmt.Sprintf("%d matches", n), Type: r.severity, Text: details.String()}
+				suite.Failures++
+			}
+
+			suite.Tests++
+			suite.Cases = append(suite.Cases, tc)
+		}
+	}
+
+	if _, err := io.WriteString(c.outStream, xml.Header); err != nil {
+		return fmt.Errorf("error writing to output: %w", err)
+	}
+	enc := xml.NewEncoder(c.outStream)
+	enc.Indent("", "  ")
+	if err := enc.Encode(junitTestSuites{Suites: []junitTestSuite{suite}}); err != nil {
+		return fmt.Errorf("error writing to output: %w", err)
+	}
+	if _, err := io.WriteString(c.outStream, "\n"); err != nil {
+		return fmt.Errorf("error writing to output: %w", err)
+	}
+	return nil
+}
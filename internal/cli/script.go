@@ -0,0 +1,116 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var scriptCommands = map[string]operationKind{
+	"replace": operationReplace,
+	"filter":  operationFilter,
+	"exclude": operationExclude,
+	"extract": operationExtract,
+}
+
+// scriptFlag reads a script file given with -f and records its commands in
+// the same list as the command line options, at the position of -f.
+type scriptFlag struct {
+	operations *[]operation
+}
+
+func (f *scriptFlag) String() string {
+	return ""
+}
+
+func (f *scriptFlag) Set(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open script file: %w", err)
+	}
+	defer file.Close()
+
+	ops, err := parseScript(file)
+	if err != nil {
+		return fmt.Errorf("%s:%w", path, err)
+	}
+
+	*f.operations = append(*f.operations, ops...)
+	return nil
+}
+
+// parseScript parses a purl script. Each line holds one command followed by
+// optional flags and an argument, for example:
+//
+//	# drop noise and normalize dates
+//	exclude -i healthcheck
+//	replace @\d{4}-\d\d-\d\d@DATE@
+//
+// The argument is the rest of the line taken as is, so patterns need no shell
+// quoting. Use "--" to end the flags when a pattern starts with "-".
+func parseScript(r io.Reader) ([]operation, error) {
+	var ops []operation
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+
+		line := strings.TrimLeft(strings.TrimSuffix(scanner.Text(), "\r"), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, rest := cutField(line)
+		kind, ok := scriptCommands[name]
+		if !ok {
+			return nil, fmt.Errorf("%d: unknown command %q", lineNo, name)
+		}
+
+		op := operation{kind: kind}
+		for strings.HasPrefix(rest, "-") {
+			var opt string
+			opt, rest = cutField(rest)
+
+			if opt == "--" {
+				break
+			}
+
+			switch opt {
+			case "-i":
+				op.ignoreCase = true
+			default:
+				return nil, fmt.Errorf("%d: unknown flag %q for %s", lineNo, opt, name)
+			}
+		}
+
+		if rest == "" {
+			return nil, fmt.Errorf("%d: missing argument for %s", lineNo, name)
+		}
+
+		if (kind == operationReplace || kind == operationExtract) && len(rest) < 3 {
+			return nil, fmt.Errorf("%d: invalid %s expression format. Use \"@search@replace@\"", lineNo, name)
+		}
+
+		op.expr = rest
+		ops = append(ops, op)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%d: %w", lineNo, err)
+	}
+
+	return ops, nil
+}
+
+// cutField returns the first whitespace separated field of s and the rest of
+// s with the separating whitespace removed.
+func cutField(s string) (string, string) {
+	i := strings.IndexAny(s, " \t")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimLeft(s[i:], " \t")
+}
@@ -0,0 +1,250 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ignoreFileNames are read in every directory while walking. Rules of later
+// files take precedence over earlier ones.
+var ignoreFileNames = []string{".gitignore", ".ignore", ".purlignore"}
+
+// ignoreRule is a single pattern of an ignore file.
+type ignoreRule struct {
+	// base is the absolute path of the directory holding the ignore file
+	base    string
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// collectFiles expands the directories in paths into the regular files below
+// them. Hidden files and files matched by ignore files are skipped unless
+// -hidden or -no-ignore is given. Files given explicitly are always kept.
+func (c *CLI) collectFiles(paths []string) ([]string, error) {
+	var files []string
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		var rules []ignoreRule
+		if !c.noIgnore {
+			rules, err = loadParentIgnoreRules(path)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		found, err := c.walkDir(path, rules)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, found...)
+	}
+
+	return files, nil
+}
+
+func (c *CLI) walkDir(dir string, rules []ignoreRule) ([]string, error) {
+	if !c.noIgnore {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		dirRules, err := loadIgnoreRules(absDir)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules[:len(rules):len(rules)], dirRules...)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(dir, name)
+
+		// .git is never processed, even with -hidden
+		if name == ".git" || (!c.includeHidden && strings.HasPrefix(name, ".")) {
+			continue
+		}
+
+		if !c.noIgnore {
+			absPath, err := filepath.Abs(path)
+			if err != nil {
+				return nil, err
+			}
+			if isIgnored(rules, absPath, entry.IsDir()) {
+				continue
+			}
+		}
+
+		switch {
+		case entry.IsDir():
+			found, err := c.walkDir(path, rules)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, found...)
+		case entry.Type().IsRegular():
+			files = append(files, path)
+		}
+	}
+
+	return files, nil
+}
+
+// loadParentIgnoreRules loads the ignore files of the directories above dir up
+// to the root of the git repository containing it, so that running on a sub
+// directory honors the ignore files of the project.
+func loadParentIgnoreRules(dir string) ([]ignoreRule, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var parents []string
+	for d := absDir; ; {
+		if d != absDir {
+			parents = append(parents, d)
+		}
+
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+			break
+		}
+
+		parent := filepath.Dir(d)
+		if parent == d {
+			// not in a git repository
+			return nil, nil
+		}
+		d = parent
+	}
+
+	var rules []ignoreRule
+	for i := len(parents) - 1; i >= 0; i-- {
+		dirRules, err := loadIgnoreRules(parents[i])
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, dirRules...)
+	}
+
+	return rules, nil
+}
+
+func loadIgnoreRules(dir string) ([]ignoreRule, error) {
+	var rules []ignoreRule
+
+	for _, name := range ignoreFileNames {
+		file, err := os.Open(filepath.Join(dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to open ignore file: %w", err)
+		}
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if rule, ok := parseIgnoreRule(dir, scanner.Text()); ok {
+				rules = append(rules, rule)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ignore file: %w", err)
+		}
+	}
+
+	return rules, nil
+}
+
+// parseIgnoreRule parses a line of an ignore file with the rules of
+// .gitignore.
+func parseIgnoreRule(base, line string) (ignoreRule, bool) {
+	line = strings.TrimSuffix(line, "\r")
+
+	// trailing spaces are ignored unless escaped with a backslash
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+
+	rule := ignoreRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	if line == "" {
+		return ignoreRule{}, false
+	}
+
+	// a pattern with a slash is relative to the directory of the ignore file,
+	// otherwise it matches a name at any depth
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	expr := globToRegexp(line)
+	if !anchored && !strings.HasPrefix(line, "**/") {
+		expr = "(?:.*/)?" + expr
+	}
+
+	re, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return ignoreRule{}, false
+	}
+	rule.re = re
+
+	return rule, true
+}
+
+// isIgnored reports whether absPath is ignored by the rules. The last matching
+// rule wins, so a negated pattern can include a file again.
+func isIgnored(rules []ignoreRule, absPath string, isDir bool) bool {
+	ignored := false
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		rel, err := filepath.Rel(rule.base, absPath)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+
+		if rule.re.MatchString(filepath.ToSlash(rel)) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,29 @@
+package purl
+
+// BinarySniffLen is the number of bytes from the start of the input that
+// IsBinary needs to see.
+const BinarySniffLen = 8000
+
+// IsBinary reports whether the data looks like binary content rather than
+// text. It is meant to be called with the first BinarySniffLen bytes of the
+// input. Data with a NUL byte is binary. Otherwise it is binary when many
+// bytes are control characters that text does not use. Bytes outside of
+// ASCII are not looked at, as text in encodings such as Shift_JIS or EUC-JP
+// is not valid UTF-8.
+func IsBinary(head []byte) bool {
+	if len(head) > BinarySniffLen {
+		head = head[:BinarySniffLen]
+	}
+
+	suspicious := 0
+	for _, b := range head {
+		if b == 0 {
+			return true
+		}
+		if b < 0x20 && b != '\t' && b != '\n' && b != '\r' && b != '\f' && b != '\b' && b != 0x1b {
+			suspicious++
+		}
+	}
+
+	return suspicious*10 > len(head)*3
+}
@@ -0,0 +1,151 @@
+package purl
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+// CompressionFormat is the compression of an input.
+type CompressionFormat string
+
+const (
+	// CompressionAuto detects the format from the magic bytes of the input.
+	CompressionAuto  CompressionFormat = "auto"
+	CompressionNone  CompressionFormat = "none"
+	CompressionGzip  CompressionFormat = "gzip"
+	CompressionBzip2 CompressionFormat = "bzip2"
+	CompressionZlib  CompressionFormat = "zlib"
+)
+
+// ParseCompressionFormat returns the format for a name accepted by the
+// -compression option.
+func ParseCompressionFormat(name string) (CompressionFormat, error) {
+	switch f := CompressionFormat(name); f {
+	case CompressionAuto, CompressionNone, CompressionGzip, CompressionBzip2, CompressionZlib:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown compression format %q. Use auto, none, gzip, bzip2 or zlib", name)
+}
+
+// bzip2HeadLen is the length of the stream header of bzip2, "BZh" and the
+// block size, followed by the magic of the first block or of the end of the
+// stream.
+const bzip2HeadLen = 10
+
+var (
+	bzip2BlockMagic = []byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x59}
+	bzip2EndMagic   = []byte{0x17, 0x72, 0x45, 0x38, 0x50, 0x90}
+)
+
+// DetectCompression returns the format of data starting with head, or
+// CompressionNone if it is not compressed.
+func DetectCompression(head []byte) CompressionFormat {
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return CompressionGzip
+	case len(head) >= bzip2HeadLen && bytes.HasPrefix(head, []byte("BZh")) && head[3] >= '1' && head[3] <= '9' &&
+		(bytes.Equal(head[4:bzip2HeadLen], bzip2BlockMagic) || bytes.Equal(head[4:bzip2HeadLen], bzip2EndMagic)):
+		// "BZh" and a digit alone is plain text too
+		return CompressionBzip2
+	case len(head) >= 2 && head[0] == 0x78 && (head[1] == 0x01 || head[1] == 0x9c || head[1] == 0xda):
+		// 0x78 0x5e is a valid zlib header too, but it is also the text "x^"
+		return CompressionZlib
+	}
+	return CompressionNone
+}
+
+// DecompressReader reads the decompressed content of an input and remembers
+// its format so that the output can be compressed the same way.
+type DecompressReader struct {
+	r          io.Reader
+	format     CompressionFormat
+	gzipHeader gzip.Header
+	closer     io.Closer
+}
+
+// NewDecompressReader returns a reader of the decompressed content of r. With
+// CompressionAuto the format is detected from the first bytes of r.
+func NewDecompressReader(r io.Reader, format CompressionFormat) (*DecompressReader, error) {
+	br := bufio.NewReader(r)
+
+	if format == CompressionAuto {
+		// wait only for the first read so that streaming input is not delayed
+		if _, err := br.Peek(1); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("error reading input: %w", err)
+		}
+		head, _ := br.Peek(min(bzip2HeadLen, br.Buffered()))
+		if len(head) < bzip2HeadLen && bytes.HasPrefix(head, []byte("BZh")) {
+			// only input that may be bzip2 waits for its whole header
+			head, _ = br.Peek(bzip2HeadLen)
+		}
+		format = DetectCompression(head)
+	}
+
+	d := &DecompressReader{r: br, format: format}
+	switch format {
+	case CompressionGzip:
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gzip input: %w", err)
+		}
+		d.r, d.gzipHeader, d.closer = gr, gr.Header, gr
+	case CompressionBzip2:
+		d.r = bzip2.NewReader(br)
+	case CompressionZlib:
+		zr, err := zlib.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read zlib input: %w", err)
+		}
+		d.r, d.closer = zr, zr
+	}
+
+	return d, nil
+}
+
+// Read reads decompressed data.
+func (d *DecompressReader) Read(p []byte) (int, error) {
+	return d.r.Read(p)
+}
+
+// Close releases the decompressor. It does not close the underlying reader.
+func (d *DecompressReader) Close() error {
+	if d.closer == nil {
+		return nil
+	}
+	return d.closer.Close()
+}
+
+// Format returns the compression format of the input.
+func (d *DecompressReader) Format() CompressionFormat {
+	return d.format
+}
+
+// NewCompressWriter returns a writer that compresses to w in the format of
+// the input, keeping the name and time of a gzip header. Close must be called
+// to flush the output. It does not close w. Writing bzip2 is not supported.
+func (d *DecompressReader) NewCompressWriter(w io.Writer) (io.WriteCloser, error) {
+	switch d.format {
+	case CompressionGzip:
+		gw := gzip.NewWriter(w)
+		gw.Header = d.gzipHeader
+		return gw, nil
+	case CompressionZlib:
+		return zlib.NewWriter(w), nil
+	case CompressionBzip2:
+		return nil, fmt.Errorf("writing bzip2 is not supported")
+	}
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,196 @@
+package purl
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Condition is a boolean expression over named patterns, such as
+// "err and (db or not retry)", evaluated against a line.
+type Condition struct {
+	root condNode
+	// positive are the patterns not under a negation, which are highlighted
+	positive []*regexp.Regexp
+}
+
+type condNode interface {
+	eval(line []byte) bool
+}
+
+type (
+	condPattern struct{ re *regexp.Regexp }
+	condNot     struct{ x condNode }
+	condAnd     struct{ x, y condNode }
+	condOr      struct{ x, y condNode }
+)
+
+func (n condPattern) eval(line []byte) bool { return n.re.Match(line) }
+func (n condNot) eval(line []byte) bool     { return !n.x.eval(line) }
+func (n condAnd) eval(line []byte) bool     { return n.x.eval(line) && n.y.eval(line) }
+func (n condOr) eval(line []byte) bool      { return n.x.eval(line) || n.y.eval(line) }
+
+// ParseCondition parses a boolean expression. Names are combined with "and",
+// "or", "not" (or "&&", "||", "!") and parentheses; "not" binds tightest and
+// "or" loosest. lookup returns the pattern of a name and is called once for
+// every name in the expression.
+func ParseCondition(expr string, lookup func(name string) (*regexp.Regexp, error)) (*Condition, error) {
+	tokens, err := tokenizeCondition(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &condParser{tokens: tokens, lookup: lookup, names: map[string]*regexp.Regexp{}}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in condition", p.tokens[p.pos])
+	}
+
+	return &Condition{root: root, positive: p.positive}, nil
+}
+
+// Match reports whether the line satisfies the condition.
+func (c *Condition) Match(line []byte) bool {
+	return c.root.eval(line)
+}
+
+// highlights returns the patterns to highlight in a line that matched.
+func (c *Condition) highlights(line []byte) []*regexp.Regexp {
+	_, res := matchesFilters(line, c.positive)
+	return res
+}
+
+type condParser struct {
+	tokens   []string
+	pos      int
+	lookup   func(name string) (*regexp.Regexp, error)
+	names    map[string]*regexp.Regexp
+	negated  int
+	positive []*regexp.Regexp
+}
+
+func (p *condParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *condParser) parseOr() (condNode, error) {
+	x, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" || p.peek() == "||" {
+		p.pos++
+		y, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		x = condOr{x, y}
+	}
+	return x, nil
+}
+
+func (p *condParser) parseAnd() (condNode, error) {
+	x, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" || p.peek() == "&&" {
+		p.pos++
+		y, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		x = condAnd{x, y}
+	}
+	return x, nil
+}
+
+func (p *condParser) parseNot() (condNode, error) {
+	if p.peek() == "not" || p.peek() == "!" {
+		p.pos++
+		p.negated++
+		x, err := p.parseNot()
+		p.negated--
+		if err != nil {
+			return nil, err
+		}
+		return condNot{x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *condParser) parsePrimary() (condNode, error) {
+	tok := p.peek()
+	switch tok {
+	case "":
+		return nil, fmt.Errorf("unexpected end of condition")
+	case "(":
+		p.pos++
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing ) in condition")
+		}
+		p.pos++
+		return x, nil
+	case ")", "and", "or", "&&", "||":
+		return nil, fmt.Errorf("unexpected %q in condition", tok)
+	}
+	p.pos++
+
+	re, ok := p.names[tok]
+	if !ok {
+		var err error
+		re, err = p.lookup(tok)
+		if err != nil {
+			return nil, err
+		}
+		p.names[tok] = re
+	}
+
+	if p.negated%2 == 0 && !slices.Contains(p.positive, re) {
+		p.positive = append(p.positive, re)
+	}
+	return condPattern{re}, nil
+}
+
+func tokenizeCondition(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		r := rune(expr[i])
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')' || r == '!':
+			tokens = append(tokens, expr[i:i+1])
+			i++
+		case strings.HasPrefix(expr[i:], "&&") || strings.HasPrefix(expr[i:], "||"):
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+		case isNameChar(r):
+			j := i
+			for j < len(expr) && isNameChar(rune(expr[j])) {
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q in condition", r)
+		}
+	}
+	return tokens, nil
+}
+
+func isNameChar(r rune) bool {
+	return r == '_' || r == '-' || r == '.' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9')
+}
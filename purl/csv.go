@@ -0,0 +1,277 @@
+package purl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+)
+
+// CSVOptions configures a CSVPipeline.
+type CSVOptions struct {
+	// Comma is the field delimiter, ',' for CSV and '\t' for TSV. It
+	// defaults to ','.
+	Comma rune
+	// Header writes the first record unchanged and lets Columns refer to
+	// columns by name.
+	Header bool
+	// Columns are the columns the stages work on, as numbers starting at 1
+	// or as names in the header. Without Columns the stages work on every
+	// column.
+	Columns []string
+}
+
+// CSVPipeline runs stages on the fields of RFC 4180 records instead of on
+// lines, so that quoted fields containing delimiters or newlines are handled
+// correctly.
+//
+// A Filter keeps a record when it keeps any of the columns, or every column
+// when it only excludes. A Replacer changes the columns. An Extractor writes
+// its output as text instead of the record, so it must be the last stage, and
+// $f1, $f2, ... in its template are the fields of the record.
+type CSVPipeline struct {
+	stages []Stage
+	opts   CSVOptions
+}
+
+// NewCSVPipeline returns a CSVPipeline of the given stages.
+func NewCSVPipeline(opts CSVOptions, stages ...Stage) *CSVPipeline {
+	if opts.Comma == 0 {
+		opts.Comma = ','
+	}
+	return &CSVPipeline{stages: stages, opts: opts}
+}
+
+// Process reads the records of r, runs them through the stages and writes the
+// records that are kept to w, quoting fields as needed. Records are written
+// with CRLF when the first line of r ends with CRLF.
+func (p *CSVPipeline) Process(ctx context.Context, r io.Reader, w io.Writer) (Stats, error) {
+	stats, err := p.process(ctx, r, w)
+	stats.Found = found(p.stages, stats)
+	return stats, err
+}
+
+func (p *CSVPipeline) process(ctx context.Context, r io.Reader, w io.Writer) (Stats, error) {
+	stats := Stats{Matches: make([]int, len(p.stages))}
+
+	for i, s := range p.stages {
+		switch s.(type) {
+		case *Filter, *Replacer:
+		case *Extractor:
+			if i != len(p.stages)-1 {
+				return stats, fmt.Errorf("an extractor must be the last stage of a CSV pipeline")
+			}
+		default:
+			return stats, fmt.Errorf("unsupported stage %T in a CSV pipeline", s)
+		}
+
+		if r, ok := s.(resetter); ok {
+			r.reset()
+		}
+	}
+
+	input := bufio.NewReader(r)
+	eol := []byte("\n")
+	// a read error is reported again by the reader
+	head, _ := input.Peek(BinarySniffLen)
+	if i := bytes.IndexByte(head, '\n'); i > 0 && head[i-1] == '\r' {
+		eol = []byte("\r\n")
+	}
+
+	reader := csv.NewReader(input)
+	reader.Comma = p.opts.Comma
+	reader.FieldsPerRecord = -1
+
+	writer := csv.NewWriter(w)
+	writer.Comma = p.opts.Comma
+	writer.UseCRLF = len(eol) == 2
+
+	write := func(record []string) error {
+		writer.Write(record)
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return fmt.Errorf("error writing to output: %w", err)
+		}
+		return nil
+	}
+
+	var columns []int
+	first := true
+	for {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("error reading CSV: %w", err)
+		}
+
+		if first {
+			first = false
+			columns, err = p.columns(record)
+			if err != nil {
+				return stats, err
+			}
+
+			if p.opts.Header {
+				if p.extracts() {
+					continue
+				}
+				if err := write(record); err != nil {
+					return stats, err
+				}
+				continue
+			}
+		}
+
+		stats.Chunks++
+		line, _ := reader.FieldPos(0)
+
+		record, extracted, matched := p.apply(record, columns, Chunk{Line: line, EOL: eol}, &stats)
+		if matched {
+			stats.Matched++
+		}
+
+		if p.extracts() {
+			stats.Output += len(extracted)
+			for _, c := range extracted {
+				if _, err := w.Write(append(c.Data, c.EOL...)); err != nil {
+					return stats, fmt.Errorf("error writing to output: %w", err)
+				}
+			}
+			continue
+		}
+
+		if record == nil {
+			continue
+		}
+		stats.Output++
+		if err := write(record); err != nil {
+			return stats, err
+		}
+	}
+
+	return stats, nil
+}
+
+// apply runs a record through every stage, using field as the template of
+// the chunks of its fields. It returns the record, or nil when it is dropped,
+// the output of a final Extractor, and whether every stage that searches for
+// something found a match.
+func (p *CSVPipeline) apply(record []string, columns []int, field Chunk, stats *Stats) ([]string, []Chunk, bool) {
+	matched := true
+	selective := false
+
+	targets := columns
+	if targets == nil {
+		targets = make([]int, len(record))
+		for i := range targets {
+			targets[i] = i
+		}
+	}
+
+	for i, s := range p.stages {
+		total := 0
+		present, kept := 0, 0
+		var extracted []Chunk
+		for _, col := range targets {
+			if col >= len(record) {
+				continue
+			}
+			present++
+
+			in := field
+			in.Data = []byte(record[col])
+
+			var out []Chunk
+			var n int
+			if e, ok := s.(*Extractor); ok {
+				out, n = e.extractRecord(record, col, in)
+			} else {
+				out, n = s.Apply(in)
+			}
+			total += n
+
+			switch s.(type) {
+			case *Filter:
+				if len(out) > 0 {
+					kept++
+				}
+			case *Replacer:
+				var data []byte
+				for _, o := range out {
+					data = append(data, o.Data...)
+				}
+				record[col] = string(data)
+			case *Extractor:
+				extracted = append(extracted, out...)
+			}
+		}
+		stats.Matches[i] += total
+
+		selectiveStage, ok := s.(selectiveStage)
+		isSelective := !ok || selectiveStage.selective()
+		if isSelective {
+			selective = true
+			matched = matched && total > 0
+		}
+
+		if _, ok := s.(*Filter); ok {
+			if (isSelective && kept == 0) || (!isSelective && kept < present) {
+				return nil, nil, false
+			}
+		}
+
+		if _, ok := s.(*Extractor); ok {
+			return nil, extracted, selective && matched
+		}
+	}
+
+	return record, nil, selective && matched
+}
+
+// columns returns the indexes of the columns of the stages, or nil for every
+// column. header is the first record.
+func (p *CSVPipeline) columns(header []string) ([]int, error) {
+	if len(p.opts.Columns) == 0 {
+		return nil, nil
+	}
+
+	columns := make([]int, 0, len(p.opts.Columns))
+	for _, col := range p.opts.Columns {
+		if n, err := strconv.Atoi(col); err == nil {
+			if n < 1 {
+				return nil, fmt.Errorf("invalid column %d: columns start at 1", n)
+			}
+			columns = append(columns, n-1)
+			continue
+		}
+
+		i := -1
+		if p.opts.Header {
+			i = slices.Index(header, col)
+		}
+		if i < 0 {
+			return nil, fmt.Errorf("unknown column %q", col)
+		}
+		columns = append(columns, i)
+	}
+	return columns, nil
+}
+
+func (p *CSVPipeline) extracts() bool {
+	if len(p.stages) == 0 {
+		return false
+	}
+	_, ok := p.stages[len(p.stages)-1].(*Extractor)
+	return ok
+}
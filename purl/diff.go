@@ -0,0 +1,238 @@
+package purl
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+)
+
+// DiffOptions configures UnifiedDiff.
+type DiffOptions struct {
+	// Context is the number of unchanged lines shown around each change.
+	Context int
+	// Color highlights the diff with ANSI escape sequences.
+	Color bool
+}
+
+const (
+	colorDiffHeader = "\x1b[1m"
+	colorDiffHunk   = "\x1b[36m"
+	colorDiffDelete = "\x1b[31m"
+	colorDiffInsert = "\x1b[32m"
+	colorDiffReset  = "\x1b[0m"
+)
+
+// diffEdit is a line kept (' '), deleted ('-') or inserted ('+'). x and y are
+// the indexes of the line in the old and the new lines, or where it would be.
+type diffEdit struct {
+	kind byte
+	x, y int
+}
+
+// UnifiedDiff returns the unified diff from a to b with the file headers of
+// oldName and newName, or nil when a and b are equal. Lines are compared
+// with their terminators, so a changed line ending is a change.
+func UnifiedDiff(oldName, newName string, a, b []byte, opts DiffOptions) []byte {
+	if bytes.Equal(a, b) {
+		return nil
+	}
+
+	oldLines := slices.Collect(bytes.Lines(a))
+	newLines := slices.Collect(bytes.Lines(b))
+	edits := diffLines(oldLines, newLines)
+
+	var out bytes.Buffer
+	colored := func(color, format string, args ...any) {
+		if opts.Color {
+			out.WriteString(color)
+		}
+		fmt.Fprintf(&out, format, args...)
+		if opts.Color {
+			out.WriteString(colorDiffReset)
+		}
+	}
+
+	colored(colorDiffHeader, "--- %s", oldName)
+	out.WriteByte('\n')
+	colored(colorDiffHeader, "+++ %s", newName)
+	out.WriteByte('\n')
+
+	for _, hunk := range diffHunks(edits, opts.Context) {
+		oldStart, oldLen, newStart, newLen := hunk[0].x, 0, hunk[0].y, 0
+		for _, e := range hunk {
+			if e.kind != '+' {
+				oldLen++
+			}
+			if e.kind != '-' {
+				newLen++
+			}
+		}
+		colored(colorDiffHunk, "@@ -%s +%s @@", hunkRange(oldStart, oldLen), hunkRange(newStart, newLen))
+		out.WriteByte('\n')
+
+		for _, e := range hunk {
+			var line []byte
+			color := ""
+			switch e.kind {
+			case ' ':
+				line = oldLines[e.x]
+			case '-':
+				line, color = oldLines[e.x], colorDiffDelete
+			case '+':
+				line, color = newLines[e.y], colorDiffInsert
+			}
+
+			content, eol := chomp(line)
+			if color != "" {
+				colored(color, "%c%s", e.kind, content)
+			} else {
+				fmt.Fprintf(&out, "%c%s", e.kind, content)
+			}
+			out.Write(eol)
+			if len(eol) == 0 {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+
+	return out.Bytes()
+}
+
+// hunkRange formats the range of a hunk header. An empty range starts at the
+// line before it.
+func hunkRange(start, n int) string {
+	switch n {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprint(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
+
+// diffHunks groups the changes with context lines around them. Changes closer
+// than twice the context share a hunk.
+func diffHunks(edits []diffEdit, context int) [][]diffEdit {
+	var hunks [][]diffEdit
+	for i := 0; i < len(edits); {
+		if edits[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		end := i
+		for j := i; j < len(edits); j++ {
+			if edits[j].kind != ' ' {
+				end = j + 1
+			} else if j-end >= 2*context {
+				break
+			}
+		}
+
+		start := max(0, i-context)
+		stop := min(len(edits), end+context)
+		hunks = append(hunks, edits[start:stop])
+		i = stop
+	}
+	return hunks
+}
+
+// diffLines returns the shortest edit script from a to b, computed with the
+// Myers algorithm.
+func diffLines(a, b [][]byte) []diffEdit {
+	// the common prefix and suffix need no search
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && bytes.Equal(a[prefix], b[prefix]) {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && bytes.Equal(a[len(a)-1-suffix], b[len(b)-1-suffix]) {
+		suffix++
+	}
+
+	var edits []diffEdit
+	for i := range prefix {
+		edits = append(edits, diffEdit{kind: ' ', x: i, y: i})
+	}
+	for _, e := range myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]) {
+		e.x += prefix
+		e.y += prefix
+		edits = append(edits, e)
+	}
+	for i := range suffix {
+		edits = append(edits, diffEdit{kind: ' ', x: len(a) - suffix + i, y: len(b) - suffix + i})
+	}
+	return edits
+}
+
+func myers(a, b [][]byte) []diffEdit {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+
+	// trace holds v[-d:d+1] as it was before every round d
+	var trace [][]int
+	found := false
+	for d := 0; d <= n+m && !found; d++ {
+		trace = append(trace, slices.Clone(v[offset-d:offset+d+1]))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && bytes.Equal(a[x], b[y]) {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	var edits []diffEdit
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		if d == 0 {
+			for x > 0 && y > 0 {
+				x--
+				y--
+				edits = append(edits, diffEdit{kind: ' ', x: x, y: y})
+			}
+			break
+		}
+
+		prev := trace[d]
+		at := func(k int) int { return prev[k+d] }
+
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			edits = append(edits, diffEdit{kind: ' ', x: x, y: y})
+		}
+		if x == prevX {
+			edits = append(edits, diffEdit{kind: '+', x: x, y: prevY})
+		} else {
+			edits = append(edits, diffEdit{kind: '-', x: prevX, y: y})
+		}
+		x, y = prevX, prevY
+	}
+
+	slices.Reverse(edits)
+	return edits
+}
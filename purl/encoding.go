@@ -0,0 +1,156 @@
+package purl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// Encoding is the character encoding of an input. The pipeline always works
+// on UTF-8, so inputs are decoded before and the output is encoded back.
+type Encoding struct {
+	name string
+	// enc is nil for UTF-8
+	enc encoding.Encoding
+	bom []byte
+}
+
+// UTF8 is the default encoding.
+var UTF8 = Encoding{name: "utf-8"}
+
+var (
+	bomUTF8    = []byte{0xef, 0xbb, 0xbf}
+	bomUTF16LE = []byte{0xff, 0xfe}
+	bomUTF16BE = []byte{0xfe, 0xff}
+)
+
+var encodingAliases = map[string]Encoding{
+	"utf-8":    UTF8,
+	"utf8":     UTF8,
+	"utf-16":   {name: "utf-16be", enc: unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)},
+	"utf-16be": {name: "utf-16be", enc: unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)},
+	"utf-16le": {name: "utf-16le", enc: unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)},
+	"sjis":     {name: "shift_jis", enc: japanese.ShiftJIS},
+	"cp932":    {name: "shift_jis", enc: japanese.ShiftJIS},
+	"eucjp":    {name: "euc-jp", enc: japanese.EUCJP},
+}
+
+// LookupEncoding returns the encoding for a name such as "shift_jis",
+// "euc-jp", "utf-16le" or "utf-8". The names of the WHATWG Encoding Standard
+// are accepted. "utf-16" without a byte order mark means big endian.
+func LookupEncoding(name string) (Encoding, error) {
+	key := strings.ToLower(strings.TrimSpace(name))
+	if e, ok := encodingAliases[key]; ok {
+		return e, nil
+	}
+
+	enc, err := htmlindex.Get(key)
+	if err != nil {
+		return Encoding{}, fmt.Errorf("unknown encoding %q", name)
+	}
+
+	canonical, err := htmlindex.Name(enc)
+	if err != nil {
+		canonical = key
+	}
+	return Encoding{name: strings.ToLower(canonical), enc: enc}, nil
+}
+
+// Name returns the name of the encoding.
+func (e Encoding) Name() string {
+	return e.name
+}
+
+// BOM reports whether the input started with a byte order mark, which is
+// written again by Encode.
+func (e Encoding) BOM() bool {
+	return len(e.bom) > 0
+}
+
+// Decode returns a reader that converts r to UTF-8. A byte order mark at the
+// start of r selects UTF-8 or UTF-16 and is removed; otherwise fallback is
+// used. The returned Encoding can be used to encode the output back.
+func Decode(r io.Reader, fallback Encoding) (io.Reader, Encoding, error) {
+	br := bufio.NewReader(r)
+
+	// wait only for the first read so that streaming input is not delayed
+	if _, err := br.Peek(1); err != nil && err != io.EOF {
+		return nil, Encoding{}, fmt.Errorf("error reading input: %w", err)
+	}
+	head, _ := br.Peek(min(len(bomUTF8), br.Buffered()))
+
+	e := fallback
+	switch {
+	case bytes.HasPrefix(head, bomUTF8):
+		e = Encoding{name: "utf-8", bom: bomUTF8}
+	case bytes.HasPrefix(head, bomUTF16LE):
+		e = encodingAliases["utf-16le"]
+		e.bom = bomUTF16LE
+	case bytes.HasPrefix(head, bomUTF16BE):
+		e = encodingAliases["utf-16be"]
+		e.bom = bomUTF16BE
+	}
+
+	if _, err := br.Discard(len(e.bom)); err != nil {
+		return nil, Encoding{}, fmt.Errorf("error reading input: %w", err)
+	}
+
+	if e.enc == nil {
+		return br, e, nil
+	}
+	return transform.NewReader(br, e.enc.NewDecoder()), e, nil
+}
+
+// WithoutBOM returns the encoding without the byte order mark of the input,
+// for output that is not the whole document written back, such as search
+// results.
+func (e Encoding) WithoutBOM() Encoding {
+	e.bom = nil
+	return e
+}
+
+// Encode returns a writer that converts UTF-8 to the encoding and writes it to
+// w, starting with the byte order mark if the input had one and the output is
+// not empty. Close must be called to flush the output. It does not close w.
+func (e Encoding) Encode(w io.Writer) io.WriteCloser {
+	ew := &encodingWriter{w: w, bom: e.bom}
+	if e.enc != nil {
+		ew.t = transform.NewWriter(w, e.enc.NewEncoder())
+	}
+	return ew
+}
+
+type encodingWriter struct {
+	w   io.Writer
+	t   *transform.Writer
+	bom []byte
+}
+
+func (ew *encodingWriter) Write(p []byte) (int, error) {
+	if len(ew.bom) > 0 && len(p) > 0 {
+		if _, err := ew.w.Write(ew.bom); err != nil {
+			return 0, err
+		}
+		ew.bom = nil
+	}
+
+	if ew.t == nil {
+		return ew.w.Write(p)
+	}
+	return ew.t.Write(p)
+}
+
+func (ew *encodingWriter) Close() error {
+	if ew.t == nil {
+		return nil
+	}
+	return ew.t.Close()
+}
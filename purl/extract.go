@@ -0,0 +1,153 @@
+package purl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ExtractorOptions configures an Extractor.
+type ExtractorOptions struct {
+	// Separator is written after each extracted text. It defaults to "\n".
+	// The terminator of a line chomped by the pipeline is used instead.
+	Separator string
+	// Fields splits the input into lines and fields. Matches are then
+	// searched line by line, only in the selected field if any, and $f1,
+	// $f2, ... in the template refer to the fields of the line.
+	Fields FieldOptions
+}
+
+// Extractor outputs a template filled with the capture groups of every match
+// of a regular expression, and drops everything else.
+type Extractor struct {
+	searchRe *regexp.Regexp
+	template string
+	opts     ExtractorOptions
+	// maxField is the largest $f reference in the template
+	maxField int
+}
+
+var fieldRefRe = regexp.MustCompile(`\$f([0-9]+)`)
+
+// NewExtractor returns an Extractor. In the template, $0 is the whole match
+// and $1, $2, ... are the capture groups. With opts.Fields, $f1, $f2, ... are
+// the fields of the line, or of the record in a CSVPipeline.
+func NewExtractor(searchRe *regexp.Regexp, template string, opts ExtractorOptions) *Extractor {
+	if opts.Separator == "" {
+		opts.Separator = "\n"
+	}
+	e := &Extractor{searchRe: searchRe, template: template, opts: opts}
+	for _, m := range fieldRefRe.FindAllStringSubmatch(template, -1) {
+		n, _ := strconv.Atoi(m[1])
+		e.maxField = max(e.maxField, n)
+	}
+	return e
+}
+
+// Apply returns one chunk for every match and the number of matches.
+func (e *Extractor) Apply(in Chunk) ([]Chunk, int) {
+	separator := e.opts.Separator
+	if len(in.EOL) > 0 {
+		separator = string(in.EOL)
+	}
+
+	if e.opts.Fields.Separator == nil {
+		out := e.extract(in.Data, 0, len(in.Data), nil, in.Line, in.Offset, separator)
+		return out, len(out)
+	}
+
+	var out []Chunk
+	lineNo := in.Line
+	offset := in.Offset
+	for line := range chunkLines(in) {
+		start, end, ok := 0, len(line), true
+		if e.opts.Fields.selects() {
+			start, end, ok = e.opts.Fields.field(line)
+		}
+		if ok {
+			out = append(out, e.extract(line, start, end, e.opts.Fields.Separator.Split(line), lineNo, offset, separator)...)
+		}
+		lineNo++
+		offset += int64(len(line))
+	}
+	return out, len(out)
+}
+
+// extractRecord fills the template for every match in a column of a CSV
+// record, with $f1, $f2, ... referring to the fields of the record.
+func (e *Extractor) extractRecord(record []string, col int, in Chunk) ([]Chunk, int) {
+	separator := e.opts.Separator
+	if len(in.EOL) > 0 {
+		separator = string(in.EOL)
+	}
+
+	var buf []byte
+	fields := make([][2]int, len(record))
+	for i, f := range record {
+		fields[i] = [2]int{len(buf), len(buf) + len(f)}
+		buf = append(buf, f...)
+	}
+
+	start, end := fields[col][0], fields[col][1]
+	out := e.extract(buf, start, end, fields, in.Line, in.Offset-int64(start), separator)
+	return out, len(out)
+}
+
+// extract fills the template for every match in src[start:end]. fields are the
+// offsets of the fields of src for $f1, $f2, ...
+func (e *Extractor) extract(src []byte, start, end int, fields [][2]int, lineNo int, offset int64, separator string) []Chunk {
+	matches := e.searchRe.FindAllSubmatchIndex(src[start:end], -1)
+
+	out := make([]Chunk, 0, len(matches))
+	last := 0
+	for _, match := range matches {
+		lineNo += bytes.Count(src[start+last:start+match[0]], []byte("\n"))
+		last = match[0]
+
+		// Construct replacements for placeholders dynamically. Fields come
+		// first so that $f1 is not taken for $1.
+		replacements := make([]string, 0, len(match)+2*e.maxField)
+		for i := e.maxField; i >= 1 && fields != nil; i-- {
+			// a field the line does not have is empty, as in awk
+			var field string
+			if i <= len(fields) {
+				field = string(src[fields[i-1][0]:fields[i-1][1]])
+			}
+			replacements = append(replacements, fmt.Sprintf("$f%d", i), field)
+		}
+		for i := len(match)/2 - 1; i >= 0; i-- { // Start from the largest index
+			var group string
+			if match[2*i] >= 0 {
+				group = string(src[start+match[2*i] : start+match[2*i+1]])
+			}
+			replacements = append(replacements, fmt.Sprintf("$%d", i), group)
+		}
+
+		result := strings.NewReplacer(replacements...).Replace(e.template) + separator
+		out = append(out, Chunk{Data: []byte(result), Line: lineNo, Offset: offset + int64(start+match[0])})
+	}
+
+	return out
+}
+
+// FindMatches returns the non-empty matches in a line, only in the selected
+// field with opts.Fields.
+func (e *Extractor) FindMatches(line []byte) []Match {
+	start, end, ok := 0, len(line), true
+	if e.opts.Fields.selects() {
+		start, end, ok = e.opts.Fields.field(line)
+	}
+	if !ok {
+		return nil
+	}
+	return findMatches(line, start, end, []*regexp.Regexp{e.searchRe})
+}
+
+// Process extracts from the whole input.
+func (e *Extractor) Process(ctx context.Context, in io.Reader, out io.Writer) (Stats, error) {
+	return NewPipeline(PipelineOptions{}, e).Process(ctx, in, out)
+}
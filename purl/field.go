@@ -0,0 +1,95 @@
+package purl
+
+import (
+	"bytes"
+	"regexp"
+)
+
+// FieldSeparator splits lines into fields, like awk's -F.
+type FieldSeparator struct {
+	// re matches a separator, or a field when splitting on blanks
+	re     *regexp.Regexp
+	blanks bool
+}
+
+var blankFieldRe = regexp.MustCompile(`[^ \t]+`)
+
+// ParseFieldSeparator returns the FieldSeparator of an awk-like -F value. A
+// single space splits on runs of spaces and tabs and ignores leading and
+// trailing blanks, a single character other than a space splits on that
+// character, and anything longer is a regular expression.
+func ParseFieldSeparator(sep string) (*FieldSeparator, error) {
+	switch {
+	case sep == " ":
+		return &FieldSeparator{re: blankFieldRe, blanks: true}, nil
+	case len([]rune(sep)) == 1:
+		return &FieldSeparator{re: regexp.MustCompile(regexp.QuoteMeta(sep))}, nil
+	}
+
+	re, err := regexp.Compile(sep)
+	if err != nil {
+		return nil, err
+	}
+	return &FieldSeparator{re: re}, nil
+}
+
+// Split returns the start and end offsets of the fields of a line. The line
+// terminator is not part of the last field.
+func (s *FieldSeparator) Split(line []byte) [][2]int {
+	content := trimEOL(line)
+
+	if s.blanks {
+		var fields [][2]int
+		for _, loc := range s.re.FindAllIndex(content, -1) {
+			fields = append(fields, [2]int{loc[0], loc[1]})
+		}
+		return fields
+	}
+
+	var fields [][2]int
+	start := 0
+	for _, loc := range s.re.FindAllIndex(content, -1) {
+		if loc[0] == loc[1] {
+			// an empty match separates nothing
+			continue
+		}
+		fields = append(fields, [2]int{start, loc[0]})
+		start = loc[1]
+	}
+	return append(fields, [2]int{start, len(content)})
+}
+
+// FieldOptions selects a field of every line for a stage to work on.
+type FieldOptions struct {
+	// Separator splits lines into fields. Without it the stage works on
+	// whole lines.
+	Separator *FieldSeparator
+	// Field is the number of the field to work on, starting at 1. Zero works
+	// on the whole line, still split into fields for the $f1, $f2, ...
+	// references of an Extractor.
+	Field int
+}
+
+// selects reports whether the stage works on a single field.
+func (o FieldOptions) selects() bool {
+	return o.Separator != nil && o.Field > 0
+}
+
+// field returns the offsets of the selected field of the line, and false when
+// the line has fewer fields.
+func (o FieldOptions) field(line []byte) (int, int, bool) {
+	fields := o.Separator.Split(line)
+	if o.Field > len(fields) {
+		return 0, 0, false
+	}
+	f := fields[o.Field-1]
+	return f[0], f[1], true
+}
+
+// trimEOL returns the line without its terminator, "\n" or "\r\n".
+func trimEOL(line []byte) []byte {
+	if !bytes.HasSuffix(line, []byte("\n")) {
+		return line
+	}
+	return bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+}
@@ -0,0 +1,330 @@
+package purl
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"regexp"
+	"slices"
+)
+
+// FilterOptions configures a Filter.
+type FilterOptions struct {
+	// Color highlights the matched text with ANSI escape sequences.
+	Color bool
+	// Before and After are the numbers of lines to keep as context before
+	// and after every matching line, like grep -B and -A. Groups of lines
+	// that are not adjacent are separated by a "--" line.
+	Before, After int
+	// ContextExcluded allows lines matched by an exclude pattern to be kept
+	// as context. Otherwise excluded lines are removed before the context is
+	// computed.
+	ContextExcluded bool
+	// OnlyMatching outputs every match of the filters in a kept line as its
+	// own line instead of the whole line. Matches are ordered by position and
+	// a match overlapping an earlier one is skipped. No context lines are
+	// kept.
+	OnlyMatching bool
+	// MatchAll requires a line to match every filter instead of any.
+	MatchAll bool
+	// Where, if set, must also be satisfied by a line to match. A Filter
+	// without filters keeps only the lines satisfying Where.
+	Where *Condition
+	// Fields restricts the filters, excludes and Where to a field of every
+	// line. A line without the field matches nothing.
+	Fields FieldOptions
+}
+
+// Filter keeps the lines that match any of its filters and none of its
+// excludes. A Filter without filters keeps every line that is not excluded.
+//
+// A Filter with context lines remembers the lines it has seen, so it must not
+// be shared by pipelines running at the same time.
+type Filter struct {
+	filters  []*regexp.Regexp
+	excludes []*regexp.Regexp
+	opts     FilterOptions
+
+	// before holds the candidates for the context of the next match
+	before []Chunk
+	// afterLeft is the number of context lines still to keep after a match
+	afterLeft int
+	// printed is set once a line has been kept, and gap when a line has been
+	// dropped since then
+	printed, gap bool
+}
+
+// NewFilter returns a Filter. Use CompileLinePatterns to compile the patterns
+// so that ^ and $ match at line boundaries.
+func NewFilter(filters, excludes []*regexp.Regexp, opts FilterOptions) *Filter {
+	return &Filter{filters: filters, excludes: excludes, opts: opts}
+}
+
+// Apply returns the kept lines of the chunk, each as its own chunk, and the
+// number of kept lines that matched a filter. With context lines, lines kept
+// before a match may come from earlier chunks.
+func (f *Filter) Apply(in Chunk) ([]Chunk, int) {
+	var out []Chunk
+	matched := 0
+
+	lineNo := in.Line
+	offset := in.Offset
+	for line := range chunkLines(in) {
+		c := Chunk{Data: line, Line: lineNo, Offset: offset}
+		if !bytes.HasSuffix(line, []byte("\n")) {
+			// the last line keeps the terminator chomped by the pipeline
+			c.EOL = in.EOL
+		}
+		lineNo++
+		offset += int64(len(line))
+
+		start, end, ok := 0, len(line), true
+		if f.opts.Fields.selects() {
+			start, end, ok = f.opts.Fields.field(line)
+		}
+
+		var hit, excluded bool
+		var hitRes []*regexp.Regexp
+		if ok {
+			hit, hitRes = f.match(line[start:end])
+			excluded, _ = matchesFilters(line[start:end], f.excludes)
+		}
+
+		if f.opts.OnlyMatching && f.selective() {
+			if hit && !excluded {
+				matched++
+				out = append(out, f.onlyMatching(c, start, end, hitRes)...)
+			}
+			continue
+		}
+
+		if f.hasContext() {
+			if hit && !excluded {
+				matched++
+				if f.opts.Color {
+					c.Data = colorSpan(line, start, end, hitRes)
+				}
+				out = f.keepMatch(out, c)
+			} else if !excluded || f.opts.ContextExcluded {
+				out = f.keepContext(out, c)
+			}
+			continue
+		}
+
+		if f.selective() && !hit {
+			continue
+		}
+
+		if excluded {
+			continue
+		}
+
+		if hit {
+			matched++
+		}
+
+		if len(hitRes) > 0 && f.opts.Color {
+			c.Data = colorSpan(line, start, end, hitRes)
+		}
+		out = append(out, c)
+	}
+
+	return out, matched
+}
+
+// Process filters the input line by line.
+func (f *Filter) Process(ctx context.Context, in io.Reader, out io.Writer) (Stats, error) {
+	return NewPipeline(PipelineOptions{}, f).Process(ctx, in, out)
+}
+
+func (f *Filter) lineOriented() bool {
+	return true
+}
+
+func (f *Filter) selective() bool {
+	return len(f.filters) > 0 || f.opts.Where != nil
+}
+
+// match reports whether a line matches the filters and the condition, and
+// returns the patterns to highlight.
+func (f *Filter) match(line []byte) (bool, []*regexp.Regexp) {
+	hit, hitRes := matchesFilters(line, f.filters)
+	if f.opts.MatchAll && len(hitRes) < len(f.filters) {
+		return false, nil
+	}
+
+	if f.opts.Where == nil {
+		return hit, hitRes
+	}
+
+	if (len(f.filters) > 0 && !hit) || !f.opts.Where.Match(line) {
+		return false, nil
+	}
+	return true, append(hitRes, f.opts.Where.highlights(line)...)
+}
+
+func (f *Filter) reset() {
+	f.before = nil
+	f.afterLeft = 0
+	f.printed = false
+	f.gap = false
+}
+
+// FindMatches returns the matches of the filters and the condition in a line
+// that the Filter keeps, ordered by position. A match overlapping an earlier
+// one is dropped, and the line terminator is never part of a match.
+func (f *Filter) FindMatches(line []byte) []Match {
+	start, end, ok := 0, len(line), true
+	if f.opts.Fields.selects() {
+		start, end, ok = f.opts.Fields.field(line)
+	}
+	if !ok {
+		return nil
+	}
+
+	hit, res := f.match(line[start:end])
+	if !hit {
+		return nil
+	}
+	if excluded, _ := matchesFilters(line[start:end], f.excludes); excluded {
+		return nil
+	}
+	return findMatches(line, start, end, res)
+}
+
+// onlyMatching returns a chunk for every match in the searched part of the
+// line, dropping the matches that overlap an earlier one.
+func (f *Filter) onlyMatching(c Chunk, start, end int, res []*regexp.Regexp) []Chunk {
+	terminator := []byte("\n")
+	if len(c.EOL) > 0 {
+		terminator = c.EOL
+	}
+
+	var out []Chunk
+	for _, m := range findMatches(c.Data, start, end, res) {
+		text := c.Data[m.Start:m.End]
+		if f.opts.Color {
+			text = fmt.Appendf(nil, "\x1b[1m\x1b[91m%s\x1b[0m", text)
+		}
+		data := append(text[:len(text):len(text)], terminator...)
+		out = append(out, Chunk{Data: data, Line: c.Line, Offset: c.Offset + int64(m.Start)})
+	}
+	return out
+}
+
+// findMatches returns the non-empty matches of res in line[start:end],
+// ordered by position and without the matches overlapping an earlier one.
+func findMatches(line []byte, start, end int, res []*regexp.Regexp) []Match {
+	// the line terminator is never part of a match
+	content := bytes.TrimSuffix(line[start:end], []byte("\n"))
+
+	var matches []Match
+	for _, re := range res {
+		for _, loc := range re.FindAllSubmatchIndex(content, -1) {
+			matches = append(matches, newMatch(re, loc, start))
+		}
+	}
+	slices.SortFunc(matches, func(a, b Match) int {
+		if a.Start != b.Start {
+			return cmp.Compare(a.Start, b.Start)
+		}
+		// the longest of the matches at the same position wins
+		return cmp.Compare(b.End, a.End)
+	})
+
+	var out []Match
+	prevEnd := 0
+	for _, m := range matches {
+		if m.Start == m.End || m.Start < prevEnd {
+			continue
+		}
+		prevEnd = m.End
+		out = append(out, m)
+	}
+	return out
+}
+
+func (f *Filter) hasContext() bool {
+	return f.selective() && (f.opts.Before > 0 || f.opts.After > 0)
+}
+
+// keepMatch appends a matching line and the context lines before it.
+func (f *Filter) keepMatch(out []Chunk, c Chunk) []Chunk {
+	if f.printed && f.gap {
+		out = append(out, Chunk{Data: []byte("--"), EOL: []byte("\n"), Kind: ChunkSeparator})
+	}
+
+	out = append(out, f.before...)
+	out = append(out, c)
+
+	f.before = f.before[:0]
+	f.afterLeft = f.opts.After
+	f.printed = true
+	f.gap = false
+	return out
+}
+
+// keepContext appends a line following a match, or remembers it in case a
+// match follows.
+func (f *Filter) keepContext(out []Chunk, c Chunk) []Chunk {
+	c.Kind = ChunkContext
+
+	if f.afterLeft > 0 {
+		f.afterLeft--
+		return append(out, c)
+	}
+
+	if len(f.before) == f.opts.Before {
+		f.gap = true
+		if len(f.before) == 0 {
+			return out
+		}
+		// the buffer is bounded, so drop the oldest line
+		copy(f.before, f.before[1:])
+		f.before = f.before[:len(f.before)-1]
+	}
+	f.before = append(f.before, c)
+	return out
+}
+
+// chunkLines returns the lines of a chunk. A chomped empty line is still a
+// line.
+func chunkLines(in Chunk) iter.Seq[[]byte] {
+	if len(in.Data) == 0 && len(in.EOL) > 0 {
+		return func(yield func([]byte) bool) {
+			yield(in.Data)
+		}
+	}
+	return bytes.Lines(in.Data)
+}
+
+func matchesFilters(line []byte, regexps []*regexp.Regexp) (bool, []*regexp.Regexp) {
+	var matchedRegexps []*regexp.Regexp
+	for _, re := range regexps {
+		if re.Match(line) {
+			matchedRegexps = append(matchedRegexps, re)
+		}
+	}
+	return len(matchedRegexps) > 0, matchedRegexps
+}
+
+// colorSpan highlights the matches in line[start:end].
+func colorSpan(line []byte, start, end int, res []*regexp.Regexp) []byte {
+	if start == 0 && end == len(line) {
+		return colorText(line, res)
+	}
+
+	out := append([]byte{}, line[:start]...)
+	out = append(out, colorText(line[start:end], res)...)
+	return append(out, line[end:]...)
+}
+
+func colorText(line []byte, res []*regexp.Regexp) []byte {
+	for _, re := range res {
+		line = re.ReplaceAll(line, []byte("\x1b[1m\x1b[91m$0\x1b[0m"))
+	}
+	return line
+}
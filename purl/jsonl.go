@@ -0,0 +1,278 @@
+package purl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// JSONPath is the path of a value in a JSON document, such as
+// ".request.path" or ".items[0].id".
+type JSONPath []string
+
+// ParseJSONPath parses a path of object keys and array indexes separated by
+// dots. An index can also be written in brackets. "." is the whole document.
+func ParseJSONPath(s string) (JSONPath, error) {
+	if !strings.HasPrefix(s, ".") {
+		return nil, fmt.Errorf("invalid path %q: it must start with '.'", s)
+	}
+	if s == "." {
+		return JSONPath{}, nil
+	}
+
+	// .items[0] is .items.0
+	keys := strings.NewReplacer("[", ".", "]", "").Replace(s[1:])
+
+	path := strings.Split(keys, ".")
+	if slices.Contains(path, "") {
+		return nil, fmt.Errorf("invalid path %q: empty key", s)
+	}
+	return JSONPath(path), nil
+}
+
+// span returns the offsets of the value at the path in a JSON document, and
+// false when there is no such value.
+func (p JSONPath) span(doc []byte) (int, int, bool) {
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	skip := func() bool {
+		var raw json.RawMessage
+		return dec.Decode(&raw) == nil
+	}
+
+	for _, key := range p {
+		tok, err := dec.Token()
+		if err != nil {
+			return 0, 0, false
+		}
+
+		switch tok {
+		case json.Delim('{'):
+			for {
+				if !dec.More() {
+					return 0, 0, false
+				}
+				name, err := dec.Token()
+				if err != nil {
+					return 0, 0, false
+				}
+				if name == key {
+					break
+				}
+				if !skip() {
+					return 0, 0, false
+				}
+			}
+		case json.Delim('['):
+			n, err := strconv.Atoi(key)
+			if err != nil || n < 0 {
+				return 0, 0, false
+			}
+			for range n {
+				if !dec.More() || !skip() {
+					return 0, 0, false
+				}
+			}
+			if !dec.More() {
+				return 0, 0, false
+			}
+		default:
+			return 0, 0, false
+		}
+	}
+
+	// the decoder stops before the separators in front of the value
+	start := int(dec.InputOffset())
+	for start < len(doc) && bytes.IndexByte([]byte(" \t\r\n:,"), doc[start]) >= 0 {
+		start++
+	}
+	if !skip() {
+		return 0, 0, false
+	}
+	return start, int(dec.InputOffset()), true
+}
+
+// JSONOptions configures a JSONStage.
+type JSONOptions struct {
+	// Keys are the paths of the values to work on.
+	Keys []JSONPath
+	// OnInvalid, if set, is called for every line that is not JSON. Such
+	// lines are passed through unchanged by a Replacer and a Filter that only
+	// excludes, and dropped otherwise. Empty lines are ignored.
+	OnInvalid func(line Chunk)
+}
+
+// JSONStage runs a Filter, Replacer or Extractor on values of JSON lines
+// instead of on the raw lines, so that keys and other values are never
+// matched.
+//
+// The Filter sees the text of a string, or the JSON of any other value, and
+// the line is kept when it keeps any of the values, or every value found when
+// it only excludes. The Replacer only changes strings, and the line is
+// written back with the other keys and spacing unchanged. The Extractor
+// outputs text instead of the line.
+type JSONStage struct {
+	stage Stage
+	opts  JSONOptions
+}
+
+// NewJSONStage returns a JSONStage that runs stage, which must be a Filter, a
+// Replacer or an Extractor.
+func NewJSONStage(stage Stage, opts JSONOptions) *JSONStage {
+	return &JSONStage{stage: stage, opts: opts}
+}
+
+// Apply runs the stage on the values of every line of the chunk.
+func (s *JSONStage) Apply(in Chunk) ([]Chunk, int) {
+	var out []Chunk
+	var replaced []byte
+	total := 0
+
+	lineNo := in.Line
+	offset := in.Offset
+	for line := range chunkLines(in) {
+		c := Chunk{Data: line, Line: lineNo, Offset: offset}
+		if !bytes.HasSuffix(line, []byte("\n")) {
+			c.EOL = in.EOL
+		}
+		lineNo++
+		offset += int64(len(line))
+
+		content := trimEOL(line)
+		if !json.Valid(content) {
+			if s.opts.OnInvalid != nil && len(bytes.TrimSpace(content)) > 0 {
+				s.opts.OnInvalid(c)
+			}
+			// the stage never sees them, so only a stage that keeps what it
+			// does not exclude keeps them
+			if !s.selective() {
+				out = append(out, c)
+			}
+			replaced = append(replaced, line...)
+			continue
+		}
+
+		eol := line[len(content):]
+		if len(eol) == 0 {
+			eol = c.EOL
+		}
+		if len(eol) == 0 {
+			eol = []byte("\n")
+		}
+
+		chunks, n, keep := s.applyLine(c, len(content), eol)
+		total += n
+
+		switch s.stage.(type) {
+		case *Replacer:
+			replaced = append(replaced, chunks[0].Data...)
+		case *Extractor:
+			out = append(out, chunks...)
+		default:
+			if keep {
+				out = append(out, c)
+			}
+		}
+	}
+
+	if _, ok := s.stage.(*Replacer); ok {
+		in.Data = replaced
+		return []Chunk{in}, total
+	}
+	return out, total
+}
+
+// applyLine runs the stage on the values of a line whose JSON ends at end. It
+// returns the line changed by a Replacer or the output of an Extractor, the
+// number of matches, and whether a Filter keeps the line.
+func (s *JSONStage) applyLine(c Chunk, end int, eol []byte) ([]Chunk, int, bool) {
+	line := c.Data
+	var extracted []Chunk
+	total, present, kept := 0, 0, 0
+
+	for _, key := range s.opts.Keys {
+		start, stop, ok := key.span(line[:end])
+		if !ok {
+			continue
+		}
+		present++
+
+		raw := line[start:stop]
+		isString := raw[0] == '"'
+		value := raw
+		if isString {
+			var text string
+			if err := json.Unmarshal(raw, &text); err != nil {
+				continue
+			}
+			value = []byte(text)
+		}
+
+		in := Chunk{Data: value, Line: c.Line, Offset: c.Offset + int64(start), EOL: eol}
+
+		switch st := s.stage.(type) {
+		case *Replacer:
+			if !isString {
+				continue
+			}
+			out, n := st.Apply(in)
+			total += n
+			if n == 0 {
+				continue
+			}
+
+			var b bytes.Buffer
+			enc := json.NewEncoder(&b)
+			enc.SetEscapeHTML(false)
+			if err := enc.Encode(string(out[0].Data)); err != nil {
+				continue
+			}
+			encoded := bytes.TrimSuffix(b.Bytes(), []byte("\n"))
+
+			line = append(append(append([]byte{}, line[:start]...), encoded...), line[stop:]...)
+			end += len(encoded) - len(raw)
+		case *Extractor:
+			out, n := st.Apply(in)
+			total += n
+			extracted = append(extracted, out...)
+		default:
+			out, n := s.stage.Apply(in)
+			total += n
+			if len(out) > 0 {
+				kept++
+			}
+		}
+	}
+
+	switch s.stage.(type) {
+	case *Replacer:
+		c.Data = line
+		return []Chunk{c}, total, true
+	case *Extractor:
+		return extracted, total, false
+	}
+
+	if s.selective() {
+		return nil, total, kept > 0
+	}
+	return nil, total, kept == present
+}
+
+func (s *JSONStage) lineOriented() bool {
+	return true
+}
+
+func (s *JSONStage) selective() bool {
+	if ss, ok := s.stage.(selectiveStage); ok {
+		return ss.selective()
+	}
+	return true
+}
+
+func (s *JSONStage) reset() {
+	if r, ok := s.stage.(resetter); ok {
+		r.reset()
+	}
+}
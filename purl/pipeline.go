@@ -0,0 +1,305 @@
+package purl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// PipelineOptions configures a Pipeline.
+type PipelineOptions struct {
+	// LineMode processes the input one line at a time and emits output as
+	// soon as each line is processed. Otherwise the whole input is read first
+	// unless every stage works on single lines.
+	LineMode bool
+	// Chomp removes the line terminator, "\n" or "\r\n", from every line
+	// before the stages see it and writes it back unchanged after the
+	// output of the line, so that $ and ^$ work on CRLF input. It implies
+	// LineMode.
+	Chomp bool
+	// Scope restricts the stages to the lines in scope. Lines out of scope
+	// are dropped, or written unchanged with PassThrough. Without LineMode,
+	// every run of adjacent lines in scope is processed as a whole.
+	Scope Scope
+	// PassThrough writes the lines out of Scope unchanged.
+	PassThrough bool
+}
+
+// Pipeline runs its stages in order, each stage consuming the output of the
+// previous one.
+type Pipeline struct {
+	stages []Stage
+	opts   PipelineOptions
+}
+
+// NewPipeline returns a pipeline of the given stages.
+func NewPipeline(opts PipelineOptions, stages ...Stage) *Pipeline {
+	return &Pipeline{stages: stages, opts: opts}
+}
+
+// lineStage is implemented by stages that give the same result whether the
+// input is processed as a whole or line by line.
+type lineStage interface {
+	lineOriented() bool
+}
+
+// selectiveStage is implemented by stages that may not search for anything,
+// such as a Filter with only exclude patterns. Such stages are ignored when
+// deciding whether a chunk matched.
+type selectiveStage interface {
+	selective() bool
+}
+
+// resetter is implemented by stages that keep state between chunks. The state
+// is reset at the start of every input.
+type resetter interface {
+	reset()
+}
+
+func (p *Pipeline) streaming() bool {
+	if p.opts.LineMode || p.opts.Chomp {
+		return true
+	}
+
+	for _, s := range p.stages {
+		if ls, ok := s.(lineStage); !ok || !ls.lineOriented() {
+			return false
+		}
+	}
+	return true
+}
+
+// apply runs a chunk through every stage. The chunk is considered matched only
+// when every stage that searches for something found a match in it.
+func (p *Pipeline) apply(in Chunk, stats *Stats) ([]Chunk, bool) {
+	matched := true
+	selective := false
+
+	chunks := []Chunk{in}
+	for i, s := range p.stages {
+		var next []Chunk
+		total := 0
+		for _, c := range chunks {
+			out, n := s.Apply(c)
+			total += n
+			for _, o := range out {
+				if len(o.Data) > 0 || len(o.EOL) > 0 {
+					next = append(next, o)
+				}
+			}
+		}
+		stats.Matches[i] += total
+
+		if ss, ok := s.(selectiveStage); !ok || ss.selective() {
+			selective = true
+			matched = matched && total > 0
+		}
+
+		chunks = next
+		if len(chunks) == 0 {
+			return nil, false
+		}
+	}
+
+	return chunks, selective && matched
+}
+
+// Process reads r, runs it through the pipeline and writes the result to w.
+func (p *Pipeline) Process(ctx context.Context, r io.Reader, w io.Writer) (Stats, error) {
+	return p.Run(ctx, r, func(c Chunk) error {
+		if _, err := w.Write(c.Data); err != nil {
+			return fmt.Errorf("error writing to output: %w", err)
+		}
+		if _, err := w.Write(c.EOL); err != nil {
+			return fmt.Errorf("error writing to output: %w", err)
+		}
+		return nil
+	})
+}
+
+// Run reads r, runs it through the pipeline and calls emit for every chunk
+// that comes out of the last stage. It stops when ctx is canceled.
+func (p *Pipeline) Run(ctx context.Context, r io.Reader, emit func(Chunk) error) (Stats, error) {
+	stats, err := p.run(ctx, r, emit)
+	stats.Found = found(p.stages, stats)
+	return stats, err
+}
+
+func (p *Pipeline) run(ctx context.Context, r io.Reader, emit func(Chunk) error) (Stats, error) {
+	stats := Stats{Matches: make([]int, len(p.stages))}
+
+	for _, s := range p.stages {
+		if r, ok := s.(resetter); ok {
+			r.reset()
+		}
+	}
+	if p.opts.Scope != nil {
+		p.opts.Scope.Reset()
+	}
+
+	process := func(in Chunk) error {
+		stats.Chunks++
+
+		out, matched := p.apply(in, &stats)
+		if matched {
+			stats.Matched++
+		}
+		stats.Output += len(out)
+
+		for _, c := range out {
+			if err := emit(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	skip := func(in Chunk) error {
+		stats.Chunks++
+		if !p.opts.PassThrough {
+			return nil
+		}
+		return emit(in)
+	}
+
+	if !p.streaming() {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return stats, fmt.Errorf("error reading file: %w", err)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		if len(b) == 0 {
+			return stats, nil
+		}
+
+		if p.opts.Scope == nil {
+			return stats, process(Chunk{Data: b, Line: 1})
+		}
+		return stats, p.runScoped(b, process, skip)
+	}
+
+	handle := func(in Chunk, fromEnd int) error {
+		if p.opts.Scope != nil && !scopeContains(p.opts.Scope, in, fromEnd) {
+			return skip(in)
+		}
+		return process(in)
+	}
+
+	// lines near the end are held back until it is known how far from the
+	// end they are
+	var lookahead int
+	if p.opts.Scope != nil {
+		lookahead = scopeLookahead(p.opts.Scope)
+	}
+	var held []Chunk
+
+	reader := bufio.NewReader(r)
+	lineNo := 0
+	var offset int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		line, err := reader.ReadBytes('\n')
+
+		if err != nil && !errors.Is(err, io.EOF) {
+			return stats, fmt.Errorf("error reading input: %w", err)
+		}
+
+		if errors.Is(err, io.EOF) && len(line) == 0 {
+			break
+		}
+
+		lineNo++
+		in := Chunk{Data: line, Line: lineNo, Offset: offset}
+		if p.opts.Chomp {
+			in.Data, in.EOL = chomp(line)
+		}
+
+		offset += int64(len(line))
+
+		if lookahead == 0 {
+			if err := handle(in, 0); err != nil {
+				return stats, err
+			}
+			continue
+		}
+
+		held = append(held, in)
+		if len(held) > lookahead {
+			if err := handle(held[0], 0); err != nil {
+				return stats, err
+			}
+			held = held[1:]
+		}
+	}
+
+	for i, in := range held {
+		if err := handle(in, len(held)-i); err != nil {
+			return stats, err
+		}
+	}
+
+	return stats, nil
+}
+
+// runScoped splits the whole input into runs of adjacent lines in and out of
+// the scope, and processes or skips each run as one chunk.
+func (p *Pipeline) runScoped(b []byte, process, skip func(Chunk) error) error {
+	var run Chunk
+	inScope := false
+	flush := func() error {
+		if len(run.Data) == 0 {
+			return nil
+		}
+		if inScope {
+			return process(run)
+		}
+		return skip(run)
+	}
+
+	total := bytes.Count(b, []byte("\n"))
+	if !bytes.HasSuffix(b, []byte("\n")) {
+		total++
+	}
+
+	lineNo := 0
+	var offset int64
+	for line := range bytes.Lines(b) {
+		lineNo++
+		c := Chunk{Data: line, Line: lineNo, Offset: offset}
+		offset += int64(len(line))
+
+		contains := scopeContains(p.opts.Scope, c, total-lineNo+1)
+		if contains != inScope || len(run.Data) == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+			run = c
+			inScope = contains
+			continue
+		}
+		run.Data = b[run.Offset : run.Offset+int64(len(run.Data))+int64(len(line))]
+	}
+
+	return flush()
+}
+
+// chomp splits a line into its content and its terminator.
+func chomp(line []byte) ([]byte, []byte) {
+	if bytes.HasSuffix(line, []byte("\r\n")) {
+		return line[:len(line)-2], line[len(line)-2:]
+	}
+	if bytes.HasSuffix(line, []byte("\n")) {
+		return line[:len(line)-1], line[len(line)-1:]
+	}
+	return line, nil
+}
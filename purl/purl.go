@@ -0,0 +1,168 @@
+// Package purl provides the text processing engine behind the purl command.
+//
+// A Pipeline reads input from an io.Reader, passes it through stages such as
+// Replacer, Filter and Extractor in order, and writes the result to an
+// io.Writer. Input is processed line by line in line mode, or as a whole so
+// that patterns can match across lines.
+package purl
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Chunk is a piece of input passed between stages. Line and Offset locate the
+// start of Data in the original input. They are exact as long as the stages
+// before did not change the text.
+type Chunk struct {
+	Data []byte
+	// Line is the line number of the first line of Data, starting at 1.
+	Line int
+	// Offset is the byte offset of Data from the start of the input.
+	Offset int64
+	// EOL is the line terminator removed from Data when the pipeline chomps
+	// lines. It is written after Data.
+	EOL []byte
+	// Kind tells context lines and separators apart from the text selected
+	// by the stages.
+	Kind ChunkKind
+}
+
+// ChunkKind is the role of a chunk in the output.
+type ChunkKind int
+
+const (
+	// ChunkText is text selected or produced by the stages.
+	ChunkText ChunkKind = iota
+	// ChunkContext is a line kept as context around a match.
+	ChunkContext
+	// ChunkSeparator separates groups of lines that are not adjacent.
+	ChunkSeparator
+)
+
+// Stage is a step of a Pipeline. Apply transforms a chunk into zero or more
+// chunks and returns the number of matches found.
+type Stage interface {
+	Apply(in Chunk) ([]Chunk, int)
+}
+
+// Match is a match of a regular expression in a line.
+type Match struct {
+	// Start and End are the offsets of the match in the line.
+	Start, End int
+	// Groups are the capture groups of the regular expression, in order.
+	Groups []Group
+}
+
+// Group is a capture group of a Match.
+type Group struct {
+	// Name is the name of a named group, or empty.
+	Name string
+	// Start and End are the offsets of the group in the line, both -1 when
+	// the group did not take part in the match.
+	Start, End int
+}
+
+// Matcher is implemented by stages that can tell where they match in a line.
+type Matcher interface {
+	FindMatches(line []byte) []Match
+}
+
+func newMatch(re *regexp.Regexp, loc []int, offset int) Match {
+	shift := func(i int) int {
+		if i < 0 {
+			return i
+		}
+		return i + offset
+	}
+
+	m := Match{Start: shift(loc[0]), End: shift(loc[1])}
+	for i, name := range re.SubexpNames()[1:] {
+		m.Groups = append(m.Groups, Group{Name: name, Start: shift(loc[2*i+2]), End: shift(loc[2*i+3])})
+	}
+	return m
+}
+
+// Stats reports what a Pipeline found while processing an input.
+type Stats struct {
+	// Chunks is the number of chunks read: lines in line mode, otherwise 1
+	// for a non-empty input, or one for every run of lines in or out of a
+	// Scope.
+	Chunks int
+	// Matched is the number of chunks matched by every stage that searches
+	// for something.
+	Matched int
+	// Matches is the number of matches found by each stage, in order.
+	Matches []int
+	// Output is the number of chunks that came out of the last stage.
+	Output int
+	// Found reports whether the input matched as a whole: every stage that
+	// searches for something found a match somewhere in the input, and
+	// something came out of the last stage. Unlike Matched, it does not
+	// depend on how the input was split into chunks.
+	Found bool
+}
+
+// found reports whether the input matched as a whole, for Stats.Found.
+func found(stages []Stage, stats Stats) bool {
+	searches := false
+	for i, s := range stages {
+		if ss, ok := s.(selectiveStage); ok && !ss.selective() {
+			continue
+		}
+		searches = true
+		if stats.Matches[i] == 0 {
+			return false
+		}
+	}
+	return searches && stats.Output > 0
+}
+
+// ParseExpression splits an expression like "@search@replacement@" into the
+// pattern and the replacement. The first character is used as the delimiter.
+func ParseExpression(expr string) (string, string, error) {
+	if len(expr) < 3 {
+		return "", "", fmt.Errorf("invalid expression format. Use \"@search@replace@\"")
+	}
+
+	delimiter := expr[:1]
+	parts := strings.Split(expr[1:], delimiter)
+	if len(parts) < 2 {
+		return "", "", fmt.Errorf("invalid expression format. Use \"@search@replace@\"")
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// CompilePattern compiles a pattern, optionally ignoring case.
+func CompilePattern(pattern string, ignoreCase bool) (*regexp.Regexp, error) {
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile regex pattern: %w", err)
+	}
+	return re, nil
+}
+
+// CompileLinePatterns compiles patterns for matching lines. Multi-line mode
+// (?m) is always enabled so that ^ and $ match at line boundaries.
+func CompileLinePatterns(rawPatterns []string, ignoreCase bool) ([]*regexp.Regexp, error) {
+	regexps := make([]*regexp.Regexp, 0, len(rawPatterns))
+	for _, pattern := range rawPatterns {
+		if ignoreCase {
+			pattern = "(?im)" + pattern
+		} else {
+			pattern = "(?m)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex pattern: %w", err)
+		}
+		regexps = append(regexps, re)
+	}
+	return regexps, nil
+}
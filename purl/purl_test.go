@@ -0,0 +1,1199 @@
+package purl_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/catatsuy/purl/purl"
+	"golang.org/x/text/encoding/japanese"
+)
+
+func TestReplacer_Process(t *testing.T) {
+	tests := map[string]struct {
+		pattern     string
+		replacement string
+		opts        purl.ReplacerOptions
+		input       string
+		expected    string
+		matches     int
+	}{
+		"simple": {
+			pattern:     "search",
+			replacement: "replacement",
+			input:       "searchb searchc\n",
+			expected:    "replacementb replacementc\n",
+			matches:     2,
+		},
+		"capture groups": {
+			pattern:     `(?P<k>\w+)=(\w+)`,
+			replacement: "$2=${k}",
+			input:       "a=b c=d\n",
+			expected:    "b=a d=c\n",
+			matches:     2,
+		},
+		"literal": {
+			pattern:     `(\w+)=(\w+)`,
+			replacement: "$2=$1",
+			opts:        purl.ReplacerOptions{Literal: true},
+			input:       "a=b\n",
+			expected:    "$2=$1\n",
+			matches:     1,
+		},
+		"no match": {
+			pattern:     "search",
+			replacement: "replacement",
+			input:       "no match\n",
+			expected:    "no match\n",
+		},
+		"guarded": {
+			pattern:     "http:",
+			replacement: "https:",
+			opts: purl.ReplacerOptions{
+				On:    []*regexp.Regexp{regexp.MustCompile("src=")},
+				NotOn: []*regexp.Regexp{regexp.MustCompile("keep")},
+			},
+			input:    "src=http: http:\nhref=http:\nsrc=http: keep\n",
+			expected: "src=https: https:\nhref=http:\nsrc=http: keep\n",
+			matches:  2,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			r := purl.NewReplacer(regexp.MustCompile(tt.pattern), []byte(tt.replacement), tt.opts)
+
+			out := new(bytes.Buffer)
+			stats, err := r.Process(context.Background(), strings.NewReader(tt.input), out)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if out.String() != tt.expected {
+				t.Errorf("Output=%q, want %q", out.String(), tt.expected)
+			}
+
+			if stats.Matches[0] != tt.matches {
+				t.Errorf("Matches=%d, want %d", stats.Matches[0], tt.matches)
+			}
+		})
+	}
+}
+
+func TestFilter_Process(t *testing.T) {
+	filters, err := purl.CompileLinePatterns([]string{"apple", "^cherry$"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	excludes, err := purl.CompileLinePatterns([]string{"pie"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := purl.NewFilter(filters, excludes, purl.FilterOptions{})
+
+	out := new(bytes.Buffer)
+	stats, err := f.Process(context.Background(), strings.NewReader("apple\nbanana\napple pie\ncherry\n"), out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if expected := "apple\ncherry\n"; out.String() != expected {
+		t.Errorf("Output=%q, want %q", out.String(), expected)
+	}
+
+	if stats.Chunks != 4 || stats.Matched != 2 {
+		t.Errorf("Stats=%+v, want 4 chunks and 2 matched", stats)
+	}
+}
+
+func TestFilter_context(t *testing.T) {
+	filters, err := purl.CompileLinePatterns([]string{"ERROR"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	excludes, err := purl.CompileLinePatterns([]string{"debug"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := "a\nb\nERROR 1\nc\nd\ne\nERROR 2\ndebug\nERROR debug\nf\ng\n"
+
+	tests := map[string]struct {
+		opts     purl.FilterOptions
+		expected string
+	}{
+		"after": {
+			opts:     purl.FilterOptions{After: 1},
+			expected: "ERROR 1\nc\n--\nERROR 2\nf\n",
+		},
+		"before": {
+			opts:     purl.FilterOptions{Before: 2},
+			expected: "a\nb\nERROR 1\n--\nd\ne\nERROR 2\n",
+		},
+		"adjacent groups are merged": {
+			opts:     purl.FilterOptions{Before: 2, After: 2},
+			expected: "a\nb\nERROR 1\nc\nd\ne\nERROR 2\nf\ng\n",
+		},
+		"excluded lines as context": {
+			opts:     purl.FilterOptions{After: 1, ContextExcluded: true},
+			expected: "ERROR 1\nc\n--\nERROR 2\ndebug\n",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			for _, lineMode := range []bool{false, true} {
+				p := purl.NewPipeline(purl.PipelineOptions{LineMode: lineMode},
+					purl.NewReplacer(regexp.MustCompile("^"), nil, purl.ReplacerOptions{}),
+					purl.NewFilter(filters, excludes, tt.opts),
+				)
+
+				// run twice to check that no context is carried to the next input
+				for range 2 {
+					out := new(bytes.Buffer)
+					stats, err := p.Process(context.Background(), strings.NewReader(input), out)
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+
+					if out.String() != tt.expected {
+						t.Errorf("LineMode=%v: Output=%q, want %q", lineMode, out.String(), tt.expected)
+					}
+
+					if stats.Matches[1] != 2 {
+						t.Errorf("LineMode=%v: Matches=%d, want 2", lineMode, stats.Matches[1])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFilter_onlyMatching(t *testing.T) {
+	filters, err := purl.CompileLinePatterns([]string{`ab\w*`, `b`, `\d+`}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := purl.NewPipeline(purl.PipelineOptions{}, purl.NewFilter(filters, nil, purl.FilterOptions{OnlyMatching: true}))
+
+	var got []string
+	_, err = p.Run(context.Background(), strings.NewReader("x 12 abc b\nnone\n3\n"), func(c purl.Chunk) error {
+		got = append(got, fmt.Sprintf("%d:%d:%s", c.Line, c.Offset, c.Data))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// "b" inside "abc" overlaps the longer match and is skipped
+	want := []string{"1:2:12\n", "1:5:abc\n", "1:9:b\n", "3:16:3\n"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestFindMatches(t *testing.T) {
+	tests := map[string]struct {
+		stage    purl.Matcher
+		line     string
+		expected []purl.Match
+	}{
+		"filter drops lines that are not JSON": {
+			stage: purl.NewFilter([]*regexp.Regexp{regexp.MustCompile(`b+`), regexp.MustCompile(`(a)(x)?`)}, nil, purl.FilterOptions{}),
+			line:  "abba\n",
+			expected: []purl.Match{
+				{Start: 0, End: 1, Groups: []purl.Group{{Start: 0, End: 1}, {Start: -1, End: -1}}},
+				{Start: 1, End: 3},
+				{Start: 3, End: 4, Groups: []purl.Group{{Start: 3, End: 4}, {Start: -1, End: -1}}},
+			},
+		},
+		"excluded line": {
+			stage: purl.NewFilter([]*regexp.Regexp{regexp.MustCompile(`a`)}, []*regexp.Regexp{regexp.MustCompile(`b`)}, purl.FilterOptions{}),
+			line:  "ab\n",
+		},
+		"extractor with named groups": {
+			stage: purl.NewExtractor(regexp.MustCompile(`(?P<key>\w+)=(\w+)`), "$1", purl.ExtractorOptions{}),
+			line:  "a=1 b=2",
+			expected: []purl.Match{
+				{Start: 0, End: 3, Groups: []purl.Group{{Name: "key", Start: 0, End: 1}, {Start: 2, End: 3}}},
+				{Start: 4, End: 7, Groups: []purl.Group{{Name: "key", Start: 4, End: 5}, {Start: 6, End: 7}}},
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			got := tt.stage.FindMatches([]byte(tt.line))
+			if fmt.Sprint(got) != fmt.Sprint(tt.expected) {
+				t.Errorf("FindMatches=%v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseCondition(t *testing.T) {
+	lookup := func(name string) (*regexp.Regexp, error) {
+		if name == "bad" {
+			return nil, errors.New("unknown name")
+		}
+		return regexp.Compile(regexp.QuoteMeta(name))
+	}
+
+	tests := map[string]struct {
+		expr  string
+		match []string
+		skip  []string
+		err   bool
+	}{
+		"and": {
+			expr:  "a and b",
+			match: []string{"ab", "ba"},
+			skip:  []string{"a", "b"},
+		},
+		"or binds looser than and": {
+			expr:  "a and b or c",
+			match: []string{"ab", "c"},
+			skip:  []string{"a", "bx"},
+		},
+		"parentheses and not": {
+			expr:  "a and (b or not c)",
+			match: []string{"ab", "abc", "ax"},
+			skip:  []string{"ac", "bc"},
+		},
+		"symbols": {
+			expr:  "!a && (b || c)",
+			match: []string{"b", "c"},
+			skip:  []string{"ab", "x"},
+		},
+		"double negation": {
+			expr:  "not not a",
+			match: []string{"a"},
+			skip:  []string{"b"},
+		},
+		"missing parenthesis": {
+			expr: "(a and b",
+			err:  true,
+		},
+		"missing operand": {
+			expr: "a and",
+			err:  true,
+		},
+		"two names": {
+			expr: "a b",
+			err:  true,
+		},
+		"invalid character": {
+			expr: "a = b",
+			err:  true,
+		},
+		"lookup error": {
+			expr: "a or bad",
+			err:  true,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			cond, err := purl.ParseCondition(tt.expr, lookup)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error for %q", tt.expr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for _, line := range tt.match {
+				if !cond.Match([]byte(line)) {
+					t.Errorf("%q should match %q", tt.expr, line)
+				}
+			}
+			for _, line := range tt.skip {
+				if cond.Match([]byte(line)) {
+					t.Errorf("%q should not match %q", tt.expr, line)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractor_Process(t *testing.T) {
+	e := purl.NewExtractor(regexp.MustCompile(`quick ([a-z]+) fox`), "animal: $1", purl.ExtractorOptions{})
+
+	out := new(bytes.Buffer)
+	stats, err := e.Process(context.Background(), strings.NewReader("The quick brown fox\nquick red fox"), out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if expected := "animal: brown\nanimal: red\n"; out.String() != expected {
+		t.Errorf("Output=%q, want %q", out.String(), expected)
+	}
+
+	if stats.Matches[0] != 2 {
+		t.Errorf("Matches=%d, want 2", stats.Matches[0])
+	}
+}
+
+func TestPipeline_Process(t *testing.T) {
+	filters, err := purl.CompileLinePatterns([]string{"ERROR"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	excludes, err := purl.CompileLinePatterns([]string{"healthcheck"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := "2024-01-02 INFO ok\n2024-01-02 ERROR db\n2024-01-03 ERROR healthcheck\n"
+
+	for _, lineMode := range []bool{false, true} {
+		p := purl.NewPipeline(purl.PipelineOptions{LineMode: lineMode},
+			purl.NewFilter(filters, nil, purl.FilterOptions{}),
+			purl.NewReplacer(regexp.MustCompile(`\d{4}-\d\d-\d\d`), []byte("DATE"), purl.ReplacerOptions{}),
+			purl.NewFilter(nil, excludes, purl.FilterOptions{}),
+			purl.NewExtractor(regexp.MustCompile(`(\w+) ERROR (\w+)`), "$2 at $1", purl.ExtractorOptions{}),
+		)
+
+		out := new(bytes.Buffer)
+		stats, err := p.Process(context.Background(), strings.NewReader(input), out)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if expected := "db at DATE\n"; out.String() != expected {
+			t.Errorf("LineMode=%v: Output=%q, want %q", lineMode, out.String(), expected)
+		}
+
+		if stats.Matched == 0 {
+			t.Errorf("LineMode=%v: expected a match", lineMode)
+		}
+	}
+}
+
+func TestPipeline_Run(t *testing.T) {
+	filters, err := purl.CompileLinePatterns([]string{"b"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := purl.NewPipeline(purl.PipelineOptions{}, purl.NewFilter(filters, nil, purl.FilterOptions{}))
+
+	var got []purl.Chunk
+	_, err = p.Run(context.Background(), strings.NewReader("a\nb\nc\nab\n"), func(c purl.Chunk) error {
+		got = append(got, c)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []purl.Chunk{
+		{Data: []byte("b\n"), Line: 2, Offset: 2},
+		{Data: []byte("ab\n"), Line: 4, Offset: 6},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d chunks, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if string(got[i].Data) != string(want[i].Data) || got[i].Line != want[i].Line || got[i].Offset != want[i].Offset {
+			t.Errorf("chunk %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestPipeline_found(t *testing.T) {
+	filters, err := purl.CompileLinePatterns([]string{"ERROR"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		replace string
+		want    bool
+	}{
+		"every stage matched on different lines": {replace: "foo", want: true},
+		"a stage without a match":                {replace: "zzz", want: false},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			for _, lineMode := range []bool{false, true} {
+				p := purl.NewPipeline(purl.PipelineOptions{LineMode: lineMode},
+					purl.NewReplacer(regexp.MustCompile(tt.replace), []byte("bar"), purl.ReplacerOptions{}),
+					purl.NewFilter(filters, nil, purl.FilterOptions{}))
+
+				stats, err := p.Process(context.Background(), strings.NewReader("foo\nERROR\n"), io.Discard)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if stats.Found != tt.want {
+					t.Errorf("LineMode=%v: Found=%v, want %v", lineMode, stats.Found, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPipeline_chomp(t *testing.T) {
+	p := purl.NewPipeline(purl.PipelineOptions{Chomp: true}, purl.NewReplacer(regexp.MustCompile(`(?m)x$`), []byte("y"), purl.ReplacerOptions{}))
+
+	var got []purl.Chunk
+	_, err := p.Run(context.Background(), strings.NewReader("ax\r\nbx\ncx"), func(c purl.Chunk) error {
+		got = append(got, c)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []purl.Chunk{
+		{Data: []byte("ay"), EOL: []byte("\r\n"), Line: 1, Offset: 0},
+		{Data: []byte("by"), EOL: []byte("\n"), Line: 2, Offset: 4},
+		{Data: []byte("cy"), Line: 3, Offset: 7},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d chunks, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if string(got[i].Data) != string(want[i].Data) || string(got[i].EOL) != string(want[i].EOL) || got[i].Line != want[i].Line || got[i].Offset != want[i].Offset {
+			t.Errorf("chunk %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestPipeline_scope(t *testing.T) {
+	input := "a\nBEGIN\na\nEND\na\nBEGIN\na\n"
+
+	tests := map[string]struct {
+		start, end  string
+		opts        purl.RangeOptions
+		passThrough bool
+		expected    string
+	}{
+		"pass through": {
+			start:       "BEGIN",
+			end:         "END",
+			passThrough: true,
+			expected:    "a\nBEGIN\nZ\nEND\na\nBEGIN\nZ\n",
+		},
+		"drop": {
+			start:    "BEGIN",
+			end:      "END",
+			expected: "BEGIN\nZ\nEND\nBEGIN\nZ\n",
+		},
+		"exclusive": {
+			start:    "BEGIN",
+			end:      "END",
+			opts:     purl.RangeOptions{ExcludeStart: true, ExcludeEnd: true},
+			expected: "Z\nZ\n",
+		},
+		"only end": {
+			end:      "END",
+			expected: "Z\nBEGIN\nZ\nEND\n",
+		},
+		"only start": {
+			start:    "END",
+			expected: "END\nZ\nBEGIN\nZ\n",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			var start, end *regexp.Regexp
+			if tt.start != "" {
+				start = regexp.MustCompile(tt.start)
+			}
+			if tt.end != "" {
+				end = regexp.MustCompile(tt.end)
+			}
+
+			for _, lineMode := range []bool{false, true} {
+				opts := purl.PipelineOptions{
+					LineMode:    lineMode,
+					Scope:       purl.NewRange(start, end, tt.opts),
+					PassThrough: tt.passThrough,
+				}
+				p := purl.NewPipeline(opts, purl.NewReplacer(regexp.MustCompile("(?m)^a$"), []byte("Z"), purl.ReplacerOptions{}))
+
+				// the range is reset for every input
+				for range 2 {
+					out := new(bytes.Buffer)
+					if _, err := p.Process(context.Background(), strings.NewReader(input), out); err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+
+					if out.String() != tt.expected {
+						t.Errorf("LineMode=%v: Output=%q, want %q", lineMode, out.String(), tt.expected)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPipeline_lineRange(t *testing.T) {
+	input := "1\n2\n3\n4\n5\n6"
+
+	tests := map[string]struct {
+		spec     string
+		expected string
+	}{
+		"single line":        {spec: "1", expected: "1\n"},
+		"span":               {spec: "2:3", expected: "2\n3\n"},
+		"open end":           {spec: "5:", expected: "5\n6"},
+		"open start":         {spec: ":2", expected: "1\n2\n"},
+		"last lines":         {spec: "-2:", expected: "5\n6"},
+		"all but last lines": {spec: ":-3", expected: "1\n2\n3\n4\n"},
+		"last line":          {spec: "-1", expected: "6"},
+		"list":               {spec: "1,-2:-2", expected: "1\n5\n"},
+		"past the end":       {spec: "-10:2", expected: "1\n2\n"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			spans, err := purl.ParseLineSpans(tt.spec)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for _, lineMode := range []bool{false, true} {
+				opts := purl.PipelineOptions{LineMode: lineMode, Scope: purl.NewLineRange(spans...)}
+				p := purl.NewPipeline(opts, purl.NewFilter(nil, nil, purl.FilterOptions{}))
+
+				out := new(bytes.Buffer)
+				if _, err := p.Process(context.Background(), strings.NewReader(input), out); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				if out.String() != tt.expected {
+					t.Errorf("LineMode=%v: Output=%q, want %q", lineMode, out.String(), tt.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestParseLineSpans_invalid(t *testing.T) {
+	for _, spec := range []string{"", "0", "a", "3:1", "1:2:3", "1,"} {
+		if _, err := purl.ParseLineSpans(spec); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+}
+
+func TestFieldSeparator_Split(t *testing.T) {
+	tests := map[string]struct {
+		sep      string
+		line     string
+		expected []string
+	}{
+		"blanks":        {sep: " ", line: "  a \tb  c \n", expected: []string{"a", "b", "c"}},
+		"character":     {sep: ",", line: "a,,b\n", expected: []string{"a", "", "b"}},
+		"regex":         {sep: ", *", line: "a,  b,c", expected: []string{"a", "b", "c"}},
+		"crlf":          {sep: ",", line: "a,b\r\n", expected: []string{"a", "b"}},
+		"no separator":  {sep: ";", line: "a,b", expected: []string{"a,b"}},
+		"regex special": {sep: "|", line: "a|b", expected: []string{"a", "b"}},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			sep, err := purl.ParseFieldSeparator(tt.sep)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var got []string
+			for _, f := range sep.Split([]byte(tt.line)) {
+				got = append(got, tt.line[f[0]:f[1]])
+			}
+			if !slices.Equal(got, tt.expected) {
+				t.Errorf("Fields=%q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPipeline_fields(t *testing.T) {
+	input := "a,http://x,http://y\nb,c\nhttp://z,http://w,q\n"
+
+	sep, err := purl.ParseFieldSeparator(",")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := purl.FieldOptions{Separator: sep, Field: 2}
+	http := regexp.MustCompile("(?m)http")
+
+	tests := map[string]struct {
+		stage    purl.Stage
+		expected string
+	}{
+		"filter": {
+			stage:    purl.NewFilter([]*regexp.Regexp{http}, nil, purl.FilterOptions{Fields: second}),
+			expected: "a,http://x,http://y\nhttp://z,http://w,q\n",
+		},
+		"exclude": {
+			stage:    purl.NewFilter(nil, []*regexp.Regexp{http}, purl.FilterOptions{Fields: second}),
+			expected: "b,c\n",
+		},
+		"replace": {
+			stage:    purl.NewReplacer(regexp.MustCompile("http:"), []byte("https:"), purl.ReplacerOptions{Fields: second}),
+			expected: "a,https://x,http://y\nb,c\nhttp://z,https://w,q\n",
+		},
+		"extract from a field": {
+			stage:    purl.NewExtractor(regexp.MustCompile("//(.)"), "$1 $f1", purl.ExtractorOptions{Fields: second}),
+			expected: "x a\nw http://z\n",
+		},
+		"extract with fields": {
+			stage:    purl.NewExtractor(regexp.MustCompile("^."), "$0:$f3", purl.ExtractorOptions{Fields: purl.FieldOptions{Separator: sep}}),
+			expected: "a:http://y\nb:\nh:q\n",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			for _, lineMode := range []bool{false, true} {
+				p := purl.NewPipeline(purl.PipelineOptions{LineMode: lineMode}, tt.stage)
+
+				out := new(bytes.Buffer)
+				if _, err := p.Process(context.Background(), strings.NewReader(input), out); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				if out.String() != tt.expected {
+					t.Errorf("LineMode=%v: Output=%q, want %q", lineMode, out.String(), tt.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestCSVPipeline_Process(t *testing.T) {
+	input := "name,email,note\nAlice,alice@old.example,\"likes, commas\"\nBob,bob@new.example,\"multi\nline\"\n"
+
+	tests := map[string]struct {
+		opts     purl.CSVOptions
+		stages   []purl.Stage
+		input    string
+		expected string
+		matched  int
+	}{
+		"replace in a named column": {
+			opts:     purl.CSVOptions{Header: true, Columns: []string{"email"}},
+			stages:   []purl.Stage{purl.NewReplacer(regexp.MustCompile(`old\.`), []byte("new."), purl.ReplacerOptions{})},
+			expected: "name,email,note\nAlice,alice@new.example,\"likes, commas\"\nBob,bob@new.example,\"multi\nline\"\n",
+			matched:  1,
+		},
+		"quoting added by a replacement": {
+			opts:     purl.CSVOptions{Header: true, Columns: []string{"1"}},
+			stages:   []purl.Stage{purl.NewReplacer(regexp.MustCompile(`^Bob$`), []byte(`Bob "B", Jr.`), purl.ReplacerOptions{})},
+			expected: "name,email,note\nAlice,alice@old.example,\"likes, commas\"\n\"Bob \"\"B\"\", Jr.\",bob@new.example,\"multi\nline\"\n",
+			matched:  1,
+		},
+		"filter any column": {
+			opts:     purl.CSVOptions{Header: true},
+			stages:   []purl.Stage{purl.NewFilter([]*regexp.Regexp{regexp.MustCompile(`(?m)^line$`)}, nil, purl.FilterOptions{})},
+			expected: "name,email,note\nBob,bob@new.example,\"multi\nline\"\n",
+			matched:  1,
+		},
+		"exclude": {
+			opts:     purl.CSVOptions{Header: true, Columns: []string{"note"}},
+			stages:   []purl.Stage{purl.NewFilter(nil, []*regexp.Regexp{regexp.MustCompile(`,`)}, purl.FilterOptions{})},
+			expected: "name,email,note\nBob,bob@new.example,\"multi\nline\"\n",
+		},
+		"extract with fields": {
+			opts:     purl.CSVOptions{Header: true, Columns: []string{"email"}},
+			stages:   []purl.Stage{purl.NewExtractor(regexp.MustCompile(`@(.+)`), "$f1: $1", purl.ExtractorOptions{})},
+			expected: "Alice: old.example\nBob: new.example\n",
+			matched:  2,
+		},
+		"tsv with crlf": {
+			opts:     purl.CSVOptions{Comma: '\t', Columns: []string{"2"}},
+			stages:   []purl.Stage{purl.NewReplacer(regexp.MustCompile(` `), []byte("_"), purl.ReplacerOptions{})},
+			input:    "a\tb c\r\nd\t\"e\tf\"\r\n",
+			expected: "a\tb_c\r\nd\t\"e\tf\"\r\n",
+			matched:  1,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			in := input
+			if tt.input != "" {
+				in = tt.input
+			}
+
+			out := new(bytes.Buffer)
+			stats, err := purl.NewCSVPipeline(tt.opts, tt.stages...).Process(context.Background(), strings.NewReader(in), out)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if out.String() != tt.expected {
+				t.Errorf("Output=%q, want %q", out.String(), tt.expected)
+			}
+			if stats.Matched != tt.matched {
+				t.Errorf("Matched=%d, want %d", stats.Matched, tt.matched)
+			}
+		})
+	}
+}
+
+func TestCSVPipeline_errors(t *testing.T) {
+	extract := purl.NewExtractor(regexp.MustCompile("a"), "$0", purl.ExtractorOptions{})
+	replace := purl.NewReplacer(regexp.MustCompile("a"), nil, purl.ReplacerOptions{})
+
+	tests := map[string]struct {
+		opts   purl.CSVOptions
+		stages []purl.Stage
+		input  string
+	}{
+		"unknown column":       {opts: purl.CSVOptions{Header: true, Columns: []string{"x"}}, stages: []purl.Stage{replace}, input: "a,b\n"},
+		"name without header":  {opts: purl.CSVOptions{Columns: []string{"a"}}, stages: []purl.Stage{replace}, input: "a,b\n"},
+		"extract before stage": {stages: []purl.Stage{extract, replace}, input: "a,b\n"},
+		"bare quote":           {stages: []purl.Stage{replace}, input: "a,b\"c\n"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			_, err := purl.NewCSVPipeline(tt.opts, tt.stages...).Process(context.Background(), strings.NewReader(tt.input), io.Discard)
+			if err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestJSONStage(t *testing.T) {
+	input := `{"level":"info", "req": {"path": "/a?token=x"}, "msg": "token=x"}
+not json
+{"level":"error","status":500,"req":{"path":"/b"},"tags":["<b>"]}
+`
+
+	keys := func(paths ...string) []purl.JSONPath {
+		var keys []purl.JSONPath
+		for _, p := range paths {
+			key, err := purl.ParseJSONPath(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, key)
+		}
+		return keys
+	}
+	where := func(expr string) *purl.Condition {
+		cond, err := purl.ParseCondition(expr, func(name string) (*regexp.Regexp, error) {
+			return regexp.Compile(regexp.QuoteMeta(name))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cond
+	}
+
+	tests := map[string]struct {
+		stage    purl.Stage
+		keys     []purl.JSONPath
+		expected string
+	}{
+		"replace a string": {
+			stage:    purl.NewReplacer(regexp.MustCompile(`token=\w+`), []byte(`token="***"`), purl.ReplacerOptions{}),
+			keys:     keys(".req.path"),
+			expected: `{"level":"info", "req": {"path": "/a?token=\"***\""}, "msg": "token=x"}` + "\nnot json\n" + `{"level":"error","status":500,"req":{"path":"/b"},"tags":["<b>"]}` + "\n",
+		},
+		"replace without html escaping": {
+			stage:    purl.NewReplacer(regexp.MustCompile(`b`), []byte("i"), purl.ReplacerOptions{}),
+			keys:     keys(".tags[0]"),
+			expected: `{"level":"info", "req": {"path": "/a?token=x"}, "msg": "token=x"}` + "\nnot json\n" + `{"level":"error","status":500,"req":{"path":"/b"},"tags":["<i>"]}` + "\n",
+		},
+		"numbers are not replaced": {
+			stage:    purl.NewReplacer(regexp.MustCompile(`5`), []byte("4"), purl.ReplacerOptions{}),
+			keys:     keys(".status"),
+			expected: input,
+		},
+		"filter": {
+			stage:    purl.NewFilter([]*regexp.Regexp{regexp.MustCompile(`^error$`)}, nil, purl.FilterOptions{}),
+			keys:     keys(".level"),
+			expected: `{"level":"error","status":500,"req":{"path":"/b"},"tags":["<b>"]}` + "\n",
+		},
+		"filter a number": {
+			stage:    purl.NewFilter([]*regexp.Regexp{regexp.MustCompile(`^5`)}, nil, purl.FilterOptions{}),
+			keys:     keys(".status"),
+			expected: `{"level":"error","status":500,"req":{"path":"/b"},"tags":["<b>"]}` + "\n",
+		},
+		"other keys and values are not matched": {
+			stage:    purl.NewFilter([]*regexp.Regexp{regexp.MustCompile(`level|path|/a`)}, nil, purl.FilterOptions{}),
+			keys:     keys(".msg"),
+			expected: "",
+		},
+		"where drops lines that are not JSON": {
+			stage:    purl.NewFilter(nil, nil, purl.FilterOptions{Where: where("not info")}),
+			keys:     keys(".level"),
+			expected: `{"level":"error","status":500,"req":{"path":"/b"},"tags":["<b>"]}` + "\n",
+		},
+		"exclude keeps lines that are not JSON": {
+			stage:    purl.NewFilter(nil, []*regexp.Regexp{regexp.MustCompile(`token`)}, purl.FilterOptions{}),
+			keys:     keys(".req.path", ".msg"),
+			expected: "not json\n" + `{"level":"error","status":500,"req":{"path":"/b"},"tags":["<b>"]}` + "\n",
+		},
+		"extract drops lines that are not JSON": {
+			stage:    purl.NewExtractor(regexp.MustCompile(`^/(\w)`), "$1", purl.ExtractorOptions{}),
+			keys:     keys(".req.path"),
+			expected: "a\nb\n",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			for _, lineMode := range []bool{false, true} {
+				p := purl.NewPipeline(purl.PipelineOptions{LineMode: lineMode}, purl.NewJSONStage(tt.stage, purl.JSONOptions{Keys: tt.keys}))
+
+				out := new(bytes.Buffer)
+				if _, err := p.Process(context.Background(), strings.NewReader(input), out); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				if out.String() != tt.expected {
+					t.Errorf("LineMode=%v: Output=%q, want %q", lineMode, out.String(), tt.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestParseJSONPath_invalid(t *testing.T) {
+	for _, path := range []string{"", "a", ".a..b", ".a.", "..", ".a[]"} {
+		if _, err := purl.ParseJSONPath(path); err == nil {
+			t.Errorf("expected an error for %q", path)
+		}
+	}
+}
+
+func TestPipeline_canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	p := purl.NewPipeline(purl.PipelineOptions{LineMode: true}, purl.NewReplacer(regexp.MustCompile("a"), []byte("b"), purl.ReplacerOptions{}))
+
+	_, err := p.Process(ctx, strings.NewReader("a\n"), new(bytes.Buffer))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err=%v, want context.Canceled", err)
+	}
+}
+
+func TestParseExpression(t *testing.T) {
+	tests := map[string]struct {
+		expr        string
+		pattern     string
+		replacement string
+		wantError   bool
+	}{
+		"at sign":         {expr: "@a@b@", pattern: "a", replacement: "b"},
+		"other delimiter": {expr: "#a@#b#", pattern: "a@", replacement: "b"},
+		"too short":       {expr: "@a", wantError: true},
+		"no replacement":  {expr: "@abc", wantError: true},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			pattern, replacement, err := purl.ParseExpression(tt.expr)
+			if tt.wantError {
+				if err == nil {
+					t.Errorf("expected an error but got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if pattern != tt.pattern || replacement != tt.replacement {
+				t.Errorf("got (%q, %q), want (%q, %q)", pattern, replacement, tt.pattern, tt.replacement)
+			}
+		})
+	}
+}
+
+func TestIsBinary(t *testing.T) {
+	tests := map[string]struct {
+		data string
+		want bool
+	}{
+		"text":               {data: "hello\nworld\n", want: false},
+		"utf-8":              {data: "こんにちは\n", want: false},
+		"empty":              {data: "", want: false},
+		"nul byte":           {data: "hello\x00world", want: true},
+		"control characters": {data: "\x01\x02\x03\x04abc", want: true},
+		"few invalid bytes":  {data: "caf\xe9 au lait and more text\n", want: false},
+		"shift_jis":          {data: "\x93\xfa\x96\x7b\x8c\xea\n", want: false},
+		"euc-jp":             {data: "\xc6\xfc\xcb\xdc\xb8\xec\n", want: false},
+		"cut off rune":       {data: "abc\xe3\x81", want: false},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			if got := purl.IsBinary([]byte(tt.data)); got != tt.want {
+				t.Errorf("IsBinary(%q) = %v, want %v", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeEncode(t *testing.T) {
+	sjis, err := japanese.ShiftJIS.NewEncoder().String("日本語\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		encoding string
+		input    string
+		name     string
+		bom      bool
+	}{
+		"utf-8":          {input: "日本語\n", name: "utf-8"},
+		"utf-8 with bom": {input: "\xef\xbb\xbf日本語\n", name: "utf-8", bom: true},
+		"shift_jis":      {encoding: "shift_jis", input: sjis, name: "shift_jis"},
+		"sjis alias":     {encoding: "SJIS", input: sjis, name: "shift_jis"},
+		"utf-16le bom":   {input: "\xff\xfe\xe5\x65\x2c\x67\x9e\x8a\x0a\x00", name: "utf-16le", bom: true},
+		"utf-16be bom":   {encoding: "shift_jis", input: "\xfe\xff\x65\xe5\x67\x2c\x8a\x9e\x00\x0a", name: "utf-16be", bom: true},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			fallback := purl.UTF8
+			if tt.encoding != "" {
+				var err error
+				fallback, err = purl.LookupEncoding(tt.encoding)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			r, enc, err := purl.Decode(strings.NewReader(tt.input), fallback)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if enc.Name() != tt.name || enc.BOM() != tt.bom {
+				t.Errorf("encoding = (%s, %v), want (%s, %v)", enc.Name(), enc.BOM(), tt.name, tt.bom)
+			}
+
+			decoded := new(bytes.Buffer)
+			if _, err := decoded.ReadFrom(r); err != nil {
+				t.Fatal(err)
+			}
+			if decoded.String() != "日本語\n" {
+				t.Errorf("decoded = %q", decoded.String())
+			}
+
+			encoded := new(bytes.Buffer)
+			w := enc.Encode(encoded)
+			if _, err := w.Write(decoded.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if encoded.String() != tt.input {
+				t.Errorf("encoded = %q, want %q", encoded.String(), tt.input)
+			}
+		})
+	}
+}
+
+func TestEncode_bom(t *testing.T) {
+	_, enc, err := purl.Decode(strings.NewReader("\xef\xbb\xbfa\n"), purl.UTF8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		enc      purl.Encoding
+		output   string
+		expected string
+	}{
+		"kept":        {enc: enc, output: "b\n", expected: "\xef\xbb\xbfb\n"},
+		"empty":       {enc: enc, output: "", expected: ""},
+		"without bom": {enc: enc.WithoutBOM(), output: "b\n", expected: "b\n"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			encoded := new(bytes.Buffer)
+			w := tt.enc.Encode(encoded)
+			if _, err := w.Write([]byte(tt.output)); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if encoded.String() != tt.expected {
+				t.Errorf("encoded = %q, want %q", encoded.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestLookupEncoding_unknown(t *testing.T) {
+	if _, err := purl.LookupEncoding("no-such-encoding"); err == nil {
+		t.Error("expected an error but got none")
+	}
+}
+
+func TestDetectCompression(t *testing.T) {
+	tests := map[string]struct {
+		head string
+		want purl.CompressionFormat
+	}{
+		"gzip":        {head: "\x1f\x8b\x08\x00", want: purl.CompressionGzip},
+		"bzip2":       {head: "BZh91AY&SY", want: purl.CompressionBzip2},
+		"empty bzip2": {head: "BZh9\x17\x72\x45\x38\x50\x90", want: purl.CompressionBzip2},
+		"bzh9 text":   {head: "BZh9 is a header\n", want: purl.CompressionNone},
+		"short bzh9":  {head: "BZh91AY", want: purl.CompressionNone},
+		"zlib":        {head: "\x78\x9c\x01", want: purl.CompressionZlib},
+		"text":        {head: "hello", want: purl.CompressionNone},
+		"bzh text":    {head: "BZhello", want: purl.CompressionNone},
+		"caret":       {head: "x^2", want: purl.CompressionNone},
+		"too short":   {head: "\x1f", want: purl.CompressionNone},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			if got := purl.DetectCompression([]byte(tt.head)); got != tt.want {
+				t.Errorf("DetectCompression(%q) = %v, want %v", tt.head, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecompressReader_roundTrip(t *testing.T) {
+	compressed := new(bytes.Buffer)
+	gw := gzip.NewWriter(compressed)
+	gw.Name = "app.log"
+	gw.Write([]byte("hello\n"))
+	gw.Close()
+
+	d, err := purl.NewDecompressReader(compressed, purl.CompressionAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	b, err := io.ReadAll(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello\n" || d.Format() != purl.CompressionGzip {
+		t.Fatalf("got %q (%s)", b, d.Format())
+	}
+
+	out := new(bytes.Buffer)
+	w, err := d.NewCompressWriter(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("bye\n"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	gr, err := gzip.NewReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gr.Name != "app.log" {
+		t.Errorf("Name=%q, want app.log", gr.Name)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	lines := func(from, to int) string {
+		var b strings.Builder
+		for i := from; i <= to; i++ {
+			fmt.Fprintf(&b, "%d\n", i)
+		}
+		return b.String()
+	}
+
+	tests := map[string]struct {
+		a, b     string
+		opts     purl.DiffOptions
+		expected string
+	}{
+		"equal": {
+			a: "a\nb\n", b: "a\nb\n", opts: purl.DiffOptions{Context: 3},
+		},
+		"separate hunks": {
+			a: lines(1, 20), b: strings.Replace(strings.Replace(lines(1, 20), "5\n", "X5\n", 1), "15\n", "X15\n", 1),
+			opts: purl.DiffOptions{Context: 3},
+			expected: "--- old\n+++ new\n" +
+				"@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+X5\n 6\n 7\n 8\n" +
+				"@@ -12,7 +12,7 @@\n 12\n 13\n 14\n-15\n+X15\n 16\n 17\n 18\n",
+		},
+		"merged hunks": {
+			a: lines(1, 10), b: strings.Replace(strings.Replace(lines(1, 10), "3\n", "", 1), "8\n", "", 1),
+			opts:     purl.DiffOptions{Context: 2},
+			expected: "--- old\n+++ new\n@@ -1,10 +1,8 @@\n 1\n 2\n-3\n 4\n 5\n 6\n 7\n-8\n 9\n 10\n",
+		},
+		"no context": {
+			a: "a\nb\nc\n", b: "a\nc\nd\n", opts: purl.DiffOptions{},
+			expected: "--- old\n+++ new\n@@ -2 +1,0 @@\n-b\n@@ -3,0 +3 @@\n+d\n",
+		},
+		"no newline at end": {
+			a: "a\nb", b: "a\nc\n", opts: purl.DiffOptions{Context: 3},
+			expected: "--- old\n+++ new\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n",
+		},
+		"empty input": {
+			a: "", b: "a\n", opts: purl.DiffOptions{Context: 3},
+			expected: "--- old\n+++ new\n@@ -0,0 +1 @@\n+a\n",
+		},
+		"line endings": {
+			a: "a\r\n", b: "a\n", opts: purl.DiffOptions{Context: 3},
+			expected: "--- old\n+++ new\n@@ -1 +1 @@\n-a\r\n+a\n",
+		},
+		"color": {
+			a: "a\n", b: "b\n", opts: purl.DiffOptions{Context: 3, Color: true},
+			expected: "\x1b[1m--- old\x1b[0m\n\x1b[1m+++ new\x1b[0m\n\x1b[36m@@ -1 +1 @@\x1b[0m\n\x1b[31m-a\x1b[0m\n\x1b[32m+b\x1b[0m\n",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			got := purl.UnifiedDiff("old", "new", []byte(tt.a), []byte(tt.b), tt.opts)
+			if string(got) != tt.expected {
+				t.Errorf("UnifiedDiff()=%q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
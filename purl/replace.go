@@ -0,0 +1,108 @@
+package purl
+
+import (
+	"context"
+	"io"
+	"regexp"
+)
+
+// ReplacerOptions configures a Replacer.
+type ReplacerOptions struct {
+	// Literal inserts the replacement as is instead of expanding $1 and
+	// ${name} references to capture groups.
+	Literal bool
+	// On and NotOn guard the replacement: only lines matching any of On, or
+	// every line without On, and none of NotOn are changed. Matches are then
+	// searched line by line.
+	On, NotOn []*regexp.Regexp
+	// Fields restricts the replacement to a field of every line. The guards
+	// still match the whole line.
+	Fields FieldOptions
+}
+
+// Replacer replaces every match of a regular expression.
+type Replacer struct {
+	searchRe    *regexp.Regexp
+	replacement []byte
+	opts        ReplacerOptions
+}
+
+// NewReplacer returns a Replacer that replaces matches of searchRe with
+// replacement. Unless opts.Literal is set, the replacement is expanded like
+// regexp.Expand, so $1 and ${name} refer to capture groups and $$ inserts a
+// literal $.
+func NewReplacer(searchRe *regexp.Regexp, replacement []byte, opts ReplacerOptions) *Replacer {
+	return &Replacer{searchRe: searchRe, replacement: replacement, opts: opts}
+}
+
+// Apply replaces the matches in the chunk and returns the number of
+// replacements.
+func (r *Replacer) Apply(in Chunk) ([]Chunk, int) {
+	if len(r.opts.On) == 0 && len(r.opts.NotOn) == 0 && !r.opts.Fields.selects() {
+		out, n := r.replace(in.Data)
+		in.Data = out
+		return []Chunk{in}, n
+	}
+
+	var out []byte
+	total := 0
+	for line := range chunkLines(in) {
+		if !r.guarded(line) {
+			out = append(out, line...)
+			continue
+		}
+
+		start, end, ok := 0, len(line), true
+		if r.opts.Fields.selects() {
+			start, end, ok = r.opts.Fields.field(line)
+		}
+		if !ok {
+			out = append(out, line...)
+			continue
+		}
+
+		replaced, n := r.replace(line[start:end])
+		out = append(out, line[:start]...)
+		out = append(out, replaced...)
+		out = append(out, line[end:]...)
+		total += n
+	}
+	in.Data = out
+	return []Chunk{in}, total
+}
+
+// guarded reports whether the line passes the guards of the replacement.
+func (r *Replacer) guarded(line []byte) bool {
+	if on, _ := matchesFilters(line, r.opts.On); len(r.opts.On) > 0 && !on {
+		return false
+	}
+	notOn, _ := matchesFilters(line, r.opts.NotOn)
+	return !notOn
+}
+
+// Process replaces the matches in the whole input.
+func (r *Replacer) Process(ctx context.Context, in io.Reader, out io.Writer) (Stats, error) {
+	return NewPipeline(PipelineOptions{}, r).Process(ctx, in, out)
+}
+
+func (r *Replacer) replace(src []byte) ([]byte, int) {
+	matches := r.searchRe.FindAllSubmatchIndex(src, -1)
+	if len(matches) == 0 {
+		return src, 0
+	}
+
+	dst := make([]byte, 0, len(src))
+	last := 0
+	for _, match := range matches {
+		dst = append(dst, src[last:match[0]]...)
+		if r.opts.Literal {
+			dst = append(dst, r.replacement...)
+		} else {
+			dst = r.searchRe.Expand(dst, r.replacement, src, match)
+		}
+		last = match[1]
+	}
+	dst = append(dst, src[last:]...)
+
+	return dst, len(matches)
+}
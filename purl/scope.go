@@ -0,0 +1,227 @@
+package purl
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Scope selects the lines of the input that the stages of a Pipeline work on.
+type Scope interface {
+	// Reset is called at the start of every input.
+	Reset()
+	// Contains reports whether a line is in scope. It is called once for
+	// every line of the input, in order.
+	Contains(line Chunk) bool
+}
+
+// RangeOptions configures a Range.
+type RangeOptions struct {
+	// ExcludeStart leaves the line matching the start pattern out of the
+	// range.
+	ExcludeStart bool
+	// ExcludeEnd leaves the line matching the end pattern out of the range.
+	ExcludeEnd bool
+}
+
+// Range is a Scope of the lines between a line matching a start pattern and
+// the next line matching an end pattern, like sed's /start/,/end/ address.
+// A range starts again at the next match of the start pattern, and a range
+// without an end line stays open until the end of the input.
+type Range struct {
+	start, end *regexp.Regexp
+	opts       RangeOptions
+	open       bool
+	done       bool
+}
+
+// NewRange returns a Range. Without a start pattern the range starts at the
+// first line, and without an end pattern it ends at the end of the input.
+func NewRange(start, end *regexp.Regexp, opts RangeOptions) *Range {
+	r := &Range{start: start, end: end, opts: opts}
+	r.Reset()
+	return r
+}
+
+// Reset closes the range, or opens it when there is no start pattern.
+func (r *Range) Reset() {
+	r.open = r.start == nil
+	r.done = false
+}
+
+// Contains reports whether the line is in the range. As with sed, the end
+// pattern is only searched from the line after the start line.
+func (r *Range) Contains(line Chunk) bool {
+	if r.done {
+		return false
+	}
+
+	if !r.open {
+		if !r.start.Match(line.Data) {
+			return false
+		}
+		r.open = true
+		return !r.opts.ExcludeStart
+	}
+
+	if r.end != nil && r.end.Match(line.Data) {
+		r.open = false
+		// a range from the first line does not start again
+		r.done = r.start == nil
+		return !r.opts.ExcludeEnd
+	}
+
+	return true
+}
+
+// LineSpan is a span of line numbers, both inclusive. Negative numbers count
+// from the end of the input, so -1 is the last line. A zero Start means the
+// first line and a zero End means the last line.
+type LineSpan struct {
+	Start, End int
+}
+
+// ParseLineSpans parses a comma separated list of line numbers and spans such
+// as "1", "10:20", "-5:" (the last five lines) or ":-2" (all but the last
+// line).
+func ParseLineSpans(spec string) ([]LineSpan, error) {
+	var spans []LineSpan
+	for part := range strings.SplitSeq(spec, ",") {
+		part = strings.TrimSpace(part)
+
+		startText, endText, isSpan := strings.Cut(part, ":")
+		if !isSpan {
+			endText = startText
+		}
+
+		parse := func(s string) (int, error) {
+			if s == "" && isSpan {
+				return 0, nil
+			}
+			n, err := strconv.Atoi(s)
+			if err != nil || n == 0 {
+				return 0, fmt.Errorf("invalid line number %q in %q", s, spec)
+			}
+			return n, nil
+		}
+
+		start, err := parse(startText)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parse(endText)
+		if err != nil {
+			return nil, err
+		}
+
+		if start > 0 && end > 0 && start > end {
+			return nil, fmt.Errorf("invalid line span %q: %d is after %d", part, start, end)
+		}
+		spans = append(spans, LineSpan{Start: start, End: end})
+	}
+	return spans, nil
+}
+
+// LineRange is a Scope of the lines in any of its spans.
+type LineRange struct {
+	spans []LineSpan
+}
+
+// NewLineRange returns a LineRange. A Pipeline holds back as many lines as
+// the largest negative line number to find the lines near the end.
+func NewLineRange(spans ...LineSpan) *LineRange {
+	return &LineRange{spans: spans}
+}
+
+// Reset does nothing as a LineRange has no state.
+func (r *LineRange) Reset() {}
+
+// Contains reports whether the line is in a span, assuming that the line is
+// not near the end of the input. A Pipeline tells where the end is.
+func (r *LineRange) Contains(line Chunk) bool {
+	return r.containsAt(line, 0)
+}
+
+func (r *LineRange) lookahead() int {
+	n := 0
+	for _, s := range r.spans {
+		n = max(n, -s.Start, -s.End)
+	}
+	return n
+}
+
+// containsAt reports whether the line is in a span. fromEnd is 1 for the last
+// line, 2 for the line before, and 0 when the line is further from the end
+// than lookahead.
+func (r *LineRange) containsAt(line Chunk, fromEnd int) bool {
+	for _, s := range r.spans {
+		startOK := s.Start == 0 ||
+			(s.Start > 0 && line.Line >= s.Start) ||
+			(s.Start < 0 && fromEnd != 0 && fromEnd <= -s.Start)
+		endOK := s.End == 0 ||
+			(s.End > 0 && line.Line <= s.End) ||
+			(s.End < 0 && (fromEnd == 0 || fromEnd >= -s.End))
+		if startOK && endOK {
+			return true
+		}
+	}
+	return false
+}
+
+// Intersect returns a Scope of the lines in every one of scopes.
+func Intersect(scopes ...Scope) Scope {
+	return intersection(scopes)
+}
+
+type intersection []Scope
+
+func (s intersection) Reset() {
+	for _, scope := range s {
+		scope.Reset()
+	}
+}
+
+func (s intersection) Contains(line Chunk) bool {
+	return s.containsAt(line, 0)
+}
+
+func (s intersection) lookahead() int {
+	n := 0
+	for _, scope := range s {
+		n = max(n, scopeLookahead(scope))
+	}
+	return n
+}
+
+func (s intersection) containsAt(line Chunk, fromEnd int) bool {
+	contains := true
+	for _, scope := range s {
+		// every scope sees every line to keep its state
+		if !scopeContains(scope, line, fromEnd) {
+			contains = false
+		}
+	}
+	return contains
+}
+
+// lookaheadScope is implemented by scopes that depend on the distance of a
+// line from the end of the input.
+type lookaheadScope interface {
+	lookahead() int
+	containsAt(line Chunk, fromEnd int) bool
+}
+
+func scopeLookahead(s Scope) int {
+	if ls, ok := s.(lookaheadScope); ok {
+		return ls.lookahead()
+	}
+	return 0
+}
+
+func scopeContains(s Scope, line Chunk, fromEnd int) bool {
+	if ls, ok := s.(lookaheadScope); ok {
+		return ls.containsAt(line, fromEnd)
+	}
+	return s.Contains(line)
+}